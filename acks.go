@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// AckTracker keeps subscribers which acknowledge delivery of events (at-least-once mode)
+	// and events delivered to them which haven't been acknowledged yet,
+	// it exposes their acknowledgement lag on every scrape without reading the storage
+	AckTracker struct {
+		sync.Mutex
+		maxAge   time.Duration
+		sessions map[*Subscriber]ackSession
+		// connected consumers by channel and consumer id
+		consumers map[string]map[string]*ackConsumer
+		unacked   *prometheus.Desc
+		lag       *prometheus.Desc
+	}
+
+	ackSession struct {
+		channels []string
+		consumer string
+	}
+
+	// ackConsumer struct, events delivered to the consumer in a channel by ids.
+	// Events acknowledged via another instance are known on the next subscription of the consumer.
+	ackConsumer struct {
+		sessions int
+		pending  map[int64]Event
+	}
+
+	// AckRequest struct, acknowledges delivery of events to the consumer
+	AckRequest struct {
+		Consumer string   `json:"consumer"`
+		IDs      []string `json:"ids"`
+	}
+
+	// AckResponse struct
+	AckResponse struct {
+		Acked int `json:"acked"`
+	}
+)
+
+// maximum number of events in the acknowledgement request
+const maxAckIDs = 1000
+
+// consumer id is a part of storage keys, so it's limited to letters, digits and "_.-" characters
+var consumerIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// ValidateConsumerID checks id of the consumer which acknowledges events
+func ValidateConsumerID(consumerID string) error {
+	if !consumerIDRegexp.MatchString(consumerID) {
+		return fmt.Errorf("consumer %q must contain up to 128 letters, digits or \"_.-\" characters", consumerID)
+	}
+	return nil
+}
+
+// NewAckTracker is a factory func, returns a new instance of the AckTracker structure,
+// events older than max age aren't kept by storage, so they aren't waited for
+func NewAckTracker(maxAge time.Duration) *AckTracker {
+	return &AckTracker{
+		maxAge:    maxAge,
+		sessions:  make(map[*Subscriber]ackSession),
+		consumers: make(map[string]map[string]*ackConsumer),
+		unacked: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "consumer", "unacked_events"),
+			"Number of events not acknowledged by connected at-least-once consumer, by channel prefix.",
+			[]string{"channel", "consumer"}, nil,
+		),
+		lag: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "consumer", "ack_lag_seconds"),
+			"Age of the oldest event not acknowledged by connected at-least-once consumer, by channel prefix.",
+			[]string{"channel", "consumer"}, nil,
+		),
+	}
+}
+
+// open registers subscriber of the consumer with events of the channels which haven't been acknowledged yet
+func (t *AckTracker) open(listener *Subscriber, consumer string, unacked map[string][]Event) {
+	t.Lock()
+	defer t.Unlock()
+	session := ackSession{consumer: consumer}
+	for channelID, events := range unacked {
+		session.channels = append(session.channels, channelID)
+		consumers, ok := t.consumers[channelID]
+		if !ok {
+			consumers = make(map[string]*ackConsumer)
+			t.consumers[channelID] = consumers
+		}
+		c, ok := consumers[consumer]
+		if !ok {
+			c = &ackConsumer{pending: make(map[int64]Event)}
+			consumers[consumer] = c
+		}
+		c.sessions++
+		for _, event := range events {
+			c.add(event)
+		}
+	}
+	t.sessions[listener] = session
+}
+
+func (t *AckTracker) close(listener *Subscriber) {
+	t.Lock()
+	defer t.Unlock()
+	session, ok := t.sessions[listener]
+	if !ok {
+		return
+	}
+	delete(t.sessions, listener)
+	for _, channelID := range session.channels {
+		consumers := t.consumers[channelID]
+		c := consumers[session.consumer]
+		if c.sessions--; c.sessions > 0 {
+			continue
+		}
+		delete(consumers, session.consumer)
+		if len(consumers) == 0 {
+			delete(t.consumers, channelID)
+		}
+	}
+}
+
+// deliver records event submitted to the channel for all its connected consumers, see Hub.OnSubmit
+func (t *AckTracker) deliver(channelID string, event interface{}) {
+	e, ok := event.(Event)
+	// events which aren't stored, e.g. inbox changes, aren't acknowledged
+	if !ok || e.ID == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, c := range t.consumers[channelID] {
+		c.add(e)
+	}
+}
+
+// ack forgets events acknowledged by the consumer in the channels
+func (t *AckTracker) ack(channels []string, consumer string, ids []int64) {
+	t.Lock()
+	defer t.Unlock()
+	for _, channelID := range channels {
+		c, ok := t.consumers[strings.ToLower(channelID)][consumer]
+		if !ok {
+			continue
+		}
+		for _, id := range ids {
+			delete(c.pending, id)
+		}
+	}
+}
+
+// Active reports whether the consumer has subscribers of the channel,
+// garbage collector of the storage keeps acknowledgements of such consumers, see ActiveConsumers
+func (t *AckTracker) Active(channelID, consumerID string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.consumers[channelID][consumerID]
+	return ok
+}
+
+func (c *ackConsumer) add(event Event) {
+	// data isn't needed to tell the lag
+	c.pending[event.ID] = Event{ID: event.ID, TTL: event.TTL, Timestamp: event.Timestamp}
+}
+
+// Describe implements prometheus.Collector
+func (t *AckTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.unacked
+	ch <- t.lag
+}
+
+// Collect implements prometheus.Collector, events of channels with the same prefix are summed up for every consumer
+func (t *AckTracker) Collect(ch chan<- prometheus.Metric) {
+	type key struct{ channel, consumer string }
+	type value struct {
+		unacked int
+		oldest  int64
+	}
+	values := make(map[key]value)
+	now := time.Now()
+	t.Lock()
+	for channelID, consumers := range t.consumers {
+		prefix := channelPrefix(channelID)
+		for consumerID, c := range consumers {
+			k := key{prefix, consumerID}
+			v := values[k]
+			for id, event := range c.pending {
+				if event.IsExpired() || (t.maxAge > 0 && now.Sub(time.Unix(0, event.Timestamp)) > t.maxAge) {
+					delete(c.pending, id)
+					continue
+				}
+				v.unacked++
+				if v.oldest == 0 || event.Timestamp < v.oldest {
+					v.oldest = event.Timestamp
+				}
+			}
+			values[k] = v
+		}
+	}
+	t.Unlock()
+
+	for k, v := range values {
+		lag := 0.0
+		if v.oldest != 0 {
+			lag = now.Sub(time.Unix(0, v.oldest)).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(t.unacked, prometheus.GaugeValue, float64(v.unacked), k.channel, k.consumer)
+		ch <- prometheus.MustNewConstMetric(t.lag, prometheus.GaugeValue, lag, k.channel, k.consumer)
+	}
+}
+
+// unacknowledged returns not expired events in a channel which the consumer has to acknowledge
+func unacknowledged(storage Storage, channelID, consumerID string) ([]Event, error) {
+	state, err := storage.GetAckState(channelID, consumerID)
+	if err != nil || state.From == 0 {
+		return nil, err
+	}
+	var events []Event
+	for _, event := range storage.GetByLastID(channelID, state.From) {
+		if !state.Acked[event.ID] && !event.IsExpired() {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// redeliver registers the consumer in the channel on its first subscription
+// and returns events which haven't been acknowledged by it since then
+func (s *SSE) redeliver(channelID, consumerID string) ([]Event, error) {
+	channelID = strings.ToLower(channelID)
+	// events published since now have greater ids, see nextEventID
+	if _, err := s.storage.RegisterConsumer(channelID, consumerID, time.Now().UnixNano()-1); err != nil {
+		return nil, err
+	}
+	return unacknowledged(s.storage, channelID, consumerID)
+}
+
+// Ack records acknowledgements of events by the consumer in all given channels it's registered in,
+// client doesn't know which channel of the group the event has been published to.
+// Returns ErrConsumerNotRegistered if the consumer isn't registered in any of the channels.
+func (s *SSE) Ack(channels []string, consumerID string, ids []int64) error {
+	registered := false
+	for _, channelID := range channels {
+		err := s.storage.Ack(strings.ToLower(channelID), consumerID, ids)
+		if err == ErrConsumerNotRegistered {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		registered = true
+	}
+	if !registered {
+		return ErrConsumerNotRegistered
+	}
+	s.acks.ack(channels, consumerID, ids)
+	now := time.Now().UnixNano()
+	for _, id := range ids {
+		ackLatency.Observe(float64(now-id) / float64(time.Second))
+	}
+	return nil
+}
+
+// mergeEvents merges sorted lists of events, events which are in both lists are taken once
+func mergeEvents(a, b []Event) []Event {
+	if len(b) == 0 {
+		return a
+	}
+	res := make([]Event, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].ID < b[0].ID:
+			res, a = append(res, a[0]), a[1:]
+		case a[0].ID > b[0].ID:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	return append(append(res, a...), b...)
+}
+
+// ackEvents records acknowledgements of events delivered to the consumer subscribed to the channels
+func (h *Handler) ackEvents(w http.ResponseWriter, r *http.Request) {
+	channelsStr := chi.URLParam(r, "channels")
+	channels := strings.Split(channelsStr, ",")
+	log := h.requestLog(r).With(Fields{"channel": channelsStr})
+
+	req := AckRequest{}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		log.Debugf("decode json: %v", err)
+		http.Error(w, "Malformed JSON", http.StatusBadRequest)
+		return
+	}
+	if err := ValidateConsumerID(req.Consumer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxAckIDs {
+		http.Error(w, fmt.Sprintf("Too many ids, maximum is %d", maxAckIDs), http.StatusBadRequest)
+		return
+	}
+	ids := make([]int64, 0, len(req.IDs))
+	for _, v := range req.IDs {
+		id, err := parseEventID(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Wrong event id %q", v), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	// consumer id of jwt subject is bound to the subject, see consumerOfSubject
+	if token, claims, _ := jwtauth.FromContext(r.Context()); token != nil && !consumerOfSubject(claims, req.Consumer) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	err := h.sse.Ack(channels, req.Consumer, ids)
+	if err == ErrConsumerNotRegistered {
+		http.Error(w, "Consumer isn't subscribed to the channels", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("ack events: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.With(Fields{"event": "events_acked", "consumer": req.Consumer}).Debugf("channels %s: %d events acknowledged by %s", channelsStr, len(ids), req.Consumer)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(AckResponse{Acked: len(ids)}); err != nil {
+		log.Errorf("encode ack response: %v", err)
+	}
+}
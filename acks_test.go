@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRedeliver(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		hub := NewHub(defaultQueueSize, Disconnect)
+		sse := NewSSE(s, hub, NewLocalRelay(hub), time.Hour)
+		replay := Replay{Consumer: "c1"}
+
+		// reconnect subscribes with the consumer again and gets events it hasn't acknowledged
+		reconnect := func() []int64 {
+			t.Helper()
+			listener, history, err := sse.SubscribeToChannel("ch", replay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sse.Unsubscribe("ch", listener)
+			return eventIDs(history, 0)
+		}
+
+		if got := reconnect(); len(got) != 0 {
+			t.Fatalf("the first subscription: got %v, want nothing", got)
+		}
+		first, second := publish(t, sse, "ch", "first"), publish(t, sse, "ch", "second")
+
+		if got, want := reconnect(), []int64{first.ID, second.ID}; !equalIDs(got, want) {
+			t.Fatalf("not acknowledged events: got %v, want %v", got, want)
+		}
+		if err := sse.Ack([]string{"ch"}, "c1", []int64{first.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reconnect(), []int64{second.ID}; !equalIDs(got, want) {
+			t.Fatalf("after the first event is acknowledged: got %v, want %v", got, want)
+		}
+		if err := sse.Ack([]string{"ch"}, "c1", []int64{second.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if got := reconnect(); len(got) != 0 {
+			t.Fatalf("after all events are acknowledged: got %v, want nothing", got)
+		}
+
+		// another consumer gets only events published after its registration
+		replay.Consumer = "c2"
+		if got := reconnect(); len(got) != 0 {
+			t.Errorf("new consumer: got %v, want nothing", got)
+		}
+	})
+}
+
+func TestAckNotRegistered(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		if _, err := s.RegisterConsumer("ch", "c1", 1); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			channelID, consumerID string
+		}{
+			{"ch", "c2"},
+			{"empty", "c1"},
+		}
+		for _, tt := range tests {
+			if err := s.Ack(tt.channelID, tt.consumerID, []int64{10}); err != ErrConsumerNotRegistered {
+				t.Errorf("ack by %s in %s: got error %v, want %v", tt.consumerID, tt.channelID, err, ErrConsumerNotRegistered)
+			}
+			state, err := s.GetAckState(tt.channelID, tt.consumerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.From != 0 || len(state.Acked) != 0 {
+				t.Errorf("ack by %s in %s has been recorded: %+v", tt.consumerID, tt.channelID, state)
+			}
+		}
+		if err := s.Ack("ch", "c1", []int64{10}); err != nil {
+			t.Fatal(err)
+		}
+
+		// a group is acknowledged if the consumer is registered in any of its channels
+		hub := NewHub(defaultQueueSize, Disconnect)
+		sse := NewSSE(s, hub, NewLocalRelay(hub), time.Hour)
+		if err := sse.Ack([]string{"empty", "ch"}, "c1", []int64{20}); err != nil {
+			t.Errorf("ack in group: %v", err)
+		}
+		if err := sse.Ack([]string{"empty", "ch"}, "c2", []int64{20}); err != ErrConsumerNotRegistered {
+			t.Errorf("ack in group by unknown consumer: got error %v, want %v", err, ErrConsumerNotRegistered)
+		}
+	})
+}
+
+func TestAckGC(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		now := time.Now().UnixNano()
+		old := now - 2*time.Hour.Nanoseconds()
+		registrations := []struct {
+			channelID, consumerID string
+			from                  int64
+		}{
+			{"empty", "old", old},
+			{"empty", "recent", now},
+			{"forgotten", "old", old},
+			{"ch", "old", old},
+			{"empty", "connected", old},
+			{"ch", "connected", old},
+		}
+		for _, r := range registrations {
+			if _, err := s.RegisterConsumer(r.channelID, r.consumerID, r.from); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Add("ch", Event{ID: now, Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+
+		// acknowledgements of consumers with subscribers are kept as they are
+		active := func(channelID, consumerID string) bool {
+			return consumerID == "connected"
+		}
+		collectGarbageNow(t, s, time.Hour, active)
+
+		tests := []struct {
+			channelID, consumerID string
+			registered            bool
+		}{
+			// there is nothing to redeliver to consumers registered before max age in channels without events
+			{"empty", "old", false},
+			{"forgotten", "old", false},
+			{"empty", "recent", true},
+			{"ch", "old", true},
+			{"empty", "connected", true},
+		}
+		for _, tt := range tests {
+			state, err := s.GetAckState(tt.channelID, tt.consumerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if registered := state.From != 0; registered != tt.registered {
+				t.Errorf("%s in %s: registered %v, want %v", tt.consumerID, tt.channelID, registered, tt.registered)
+			}
+		}
+		// registration of consumer in channel with events is moved to the oldest kept event
+		if state, _ := s.GetAckState("ch", "old"); state.From <= old {
+			t.Errorf("registration hasn't been moved forward: %d", state.From)
+		}
+		if state, _ := s.GetAckState("ch", "connected"); state.From != old {
+			t.Errorf("registration of active consumer has been moved: %d, want %d", state.From, old)
+		}
+	})
+}
+
+// gatherAckLag returns number of unacknowledged events and the lag by channel prefix and consumer
+func gatherAckLag(t *testing.T, acks *AckTracker) (map[string]float64, map[string]float64) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(acks)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unacked, lag := make(map[string]float64), make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			k := labels["channel"] + "/" + labels["consumer"]
+			switch family.GetName() {
+			case metricsNamespace + "_consumer_unacked_events":
+				unacked[k] = m.GetGauge().GetValue()
+			case metricsNamespace + "_consumer_ack_lag_seconds":
+				lag[k] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return unacked, lag
+}
+
+func TestAckTrackerMetrics(t *testing.T) {
+	defer func(prefixes []string) { metricsChannelPrefixes = prefixes }(metricsChannelPrefixes)
+	metricsChannelPrefixes = []string{"user_"}
+
+	hub := NewHub(defaultQueueSize, Disconnect)
+	sse := NewSSE(NewMemStorage(), hub, NewLocalRelay(hub), time.Hour)
+	// an event published before the subscription is redelivered, so it's waited for
+	if _, err := sse.storage.RegisterConsumer("user_1", "c1", 1); err != nil {
+		t.Fatal(err)
+	}
+	redelivered := publish(t, sse, "user_1", "redelivered")
+
+	single, _, err := sse.SubscribeToChannel("User_1", Replay{Consumer: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, _, err := sse.SubscribeToMultiChannel([]string{"user_2", "news"}, Replay{Consumer: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := sse.SubscribeToChannel("user_2", Replay{Consumer: "c2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := publish(t, sse, "user_2", "delivered")
+	publish(t, sse, "news", "news")
+
+	// channels are labelled by their prefixes, events of the same prefix are summed up
+	unacked, lag := gatherAckLag(t, sse.acks)
+	want := map[string]float64{"user_/c1": 2, "other/c1": 1, "user_/c2": 1}
+	if len(unacked) != len(want) {
+		t.Fatalf("got unacked events %v, want %v", unacked, want)
+	}
+	for k, v := range want {
+		if unacked[k] != v || lag[k] <= 0 {
+			t.Errorf("%s: got %v unacked events with lag %v, want %v", k, unacked[k], lag[k], v)
+		}
+	}
+
+	if err := sse.Ack([]string{"user_1"}, "c1", []int64{redelivered.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sse.Ack([]string{"user_2", "news"}, "c2", []int64{delivered.ID}); err != nil {
+		t.Fatal(err)
+	}
+	unacked, lag = gatherAckLag(t, sse.acks)
+	if unacked["user_/c1"] != 1 || unacked["user_/c2"] != 0 || lag["user_/c2"] != 0 {
+		t.Errorf("after acknowledgements: got unacked events %v, lag %v", unacked, lag)
+	}
+
+	if !sse.acks.Active("user_1", "c1") || sse.acks.Active("user_1", "c2") {
+		t.Error("active consumers are wrong")
+	}
+	sse.Unsubscribe("User_1", single)
+	sse.UnsubscribeFromMultiChannel([]string{"user_2", "news"}, multi)
+	sse.Unsubscribe("user_2", other)
+	if unacked, _ = gatherAckLag(t, sse.acks); len(unacked) != 0 {
+		t.Errorf("disconnected consumers are exposed: %v", unacked)
+	}
+	if sse.acks.Active("user_1", "c1") {
+		t.Error("disconnected consumer is active")
+	}
+}
+
+func TestAckConsumerOfSubject(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	auth, err := NewAuth(AuthConfig{JWT: JWTConfig{Secret: "secret", ChannelTemplate: "user_{sub}"}}, h.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuth(auth)
+	router := h.Router()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sse.storage.RegisterConsumer("user_alice", "alice.phone", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		wantCode int
+	}{
+		{"ack by own consumer", http.MethodPost, "/ack/user_alice", `{"consumer":"alice.phone","ids":["1"]}`, http.StatusOK},
+		{"ack by subject", http.MethodPost, "/ack/user_alice", `{"consumer":"alice","ids":["1"]}`, http.StatusNotFound},
+		{"ack by consumer of another subject", http.MethodPost, "/ack/user_alice", `{"consumer":"bob","ids":["1"]}`, http.StatusForbidden},
+		{"ack by consumer with subject prefix", http.MethodPost, "/ack/user_alice", `{"consumer":"alicea","ids":["1"]}`, http.StatusForbidden},
+		{"subscription of consumer of another subject", http.MethodGet, "/sub/user_alice?consumer=bob", "", http.StatusForbidden},
+		{"poll of consumer of another subject", http.MethodGet, "/poll/user_alice?consumer=bob.phone", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		url := tt.url + "?token=" + token
+		if strings.Contains(tt.url, "?") {
+			url = tt.url + "&token=" + token
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, url, strings.NewReader(tt.body)))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+}
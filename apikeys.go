@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Operations which may be granted to an api key
+const (
+	OpPublish = "publish"
+	OpDump    = "dump"
+	OpAdmin   = "admin"
+)
+
+// name of the key built from the BASIC_TOKEN environment variable
+const legacyKeyName = "legacy"
+
+type (
+	// APIKey is a named secret of a publisher, scoped to channel patterns and operations.
+	// Several keys may share the same name to rotate the secret without downtime:
+	// a new key is added with not_before, the old one gets expires_at.
+	APIKey struct {
+		Name       string     `json:"name"`
+		Key        string     `json:"key"`
+		Channels   []string   `json:"channels"`
+		Operations []string   `json:"operations"`
+		NotBefore  *time.Time `json:"not_before,omitempty"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+
+		hash [sha256.Size]byte
+	}
+
+	// KeyStore keeps api keys loaded from the keys file
+	KeyStore struct {
+		sync.RWMutex
+		keys []*APIKey
+		// keys file, empty if keys aren't loaded from file
+		path string
+		// key which is always present in the store, e.g. legacy BASIC_TOKEN
+		static *APIKey
+	}
+
+	keysFile struct {
+		Keys []*APIKey `json:"keys"`
+	}
+
+	apiKeyContextKey struct{}
+)
+
+// NewKeyStore is a factory func, returns a new instance of the KeyStore structure
+func NewKeyStore(keys ...*APIKey) *KeyStore {
+	s := &KeyStore{}
+	s.set(keys)
+	return s
+}
+
+// NewKeyStoreFromConfig builds key store from the api keys file
+// and the legacy basic token, which is granted publish and dump on all channels,
+// admin operations require a key from the api keys file.
+// Returns nil if publishers authentication isn't configured.
+func NewKeyStoreFromConfig(cfg AuthConfig) (*KeyStore, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	path, token := cfg.APIKeysFile, cfg.BasicToken
+	s := &KeyStore{path: path}
+	if token != "" {
+		s.static = &APIKey{
+			Name:       legacyKeyName,
+			Key:        token,
+			Channels:   []string{"*"},
+			Operations: []string{OpPublish, OpDump},
+		}
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the keys file, keys are replaced only if the whole file is valid
+func (s *KeyStore) Reload() error {
+	var keys []*APIKey
+	if s.path != "" {
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("read api keys file: %v", err)
+		}
+		f := keysFile{}
+		if err := json.Unmarshal(b, &f); err != nil {
+			return fmt.Errorf("parse api keys file %s: %v", s.path, err)
+		}
+		keys = f.Keys
+	}
+	if s.static != nil {
+		static := *s.static
+		keys = append(keys, &static)
+	}
+	for i, k := range keys {
+		if err := k.validate(); err != nil {
+			return fmt.Errorf("api key #%d (%s): %v", i, k.Name, err)
+		}
+	}
+	s.set(keys)
+	return nil
+}
+
+// Len returns number of keys in the store
+func (s *KeyStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.keys)
+}
+
+// Keys returns copy of the list of keys in the store
+func (s *KeyStore) Keys() []*APIKey {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]*APIKey(nil), s.keys...)
+}
+
+// Authenticate returns the key matching the secret and valid at the given time, or nil.
+// Secret is compared with every key in constant time, so timing doesn't tell which key is close.
+func (s *KeyStore) Authenticate(secret string, now time.Time) *APIKey {
+	if secret == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+
+	s.RLock()
+	defer s.RUnlock()
+	var found *APIKey
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 && k.activeAt(now) {
+			found = k
+		}
+	}
+	return found
+}
+
+// AuthenticateSignature returns the key with the given name whose secret was used
+// to sign the message with HMAC-SHA256, or nil. Every active key with the name is tried,
+// so a request signed with either the old or the new secret is accepted during rotation.
+func (s *KeyStore) AuthenticateSignature(name string, message, signature []byte, now time.Time) *APIKey {
+	if name == "" || len(signature) == 0 {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	var found *APIKey
+	for _, k := range s.keys {
+		if k.Name != name || !k.activeAt(now) {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(k.Key))
+		mac.Write(message)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			found = k
+		}
+	}
+	return found
+}
+
+func (s *KeyStore) set(keys []*APIKey) {
+	for _, k := range keys {
+		k.hash = sha256.Sum256([]byte(k.Key))
+	}
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+}
+
+// Allows reports whether key grants operation on the channel,
+// empty channel id checks the operation only
+func (k *APIKey) Allows(op, channelID string) bool {
+	if k == nil {
+		return false
+	}
+	granted := false
+	for _, o := range k.Operations {
+		if o == op {
+			granted = true
+			break
+		}
+	}
+	return granted && (channelID == "" || matchChannel(k.Channels, channelID))
+}
+
+func (k *APIKey) activeAt(t time.Time) bool {
+	if k.NotBefore != nil && t.Before(*k.NotBefore) {
+		return false
+	}
+	if k.ExpiresAt != nil && !t.Before(*k.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+func (k *APIKey) validate() error {
+	if k.Name == "" {
+		return errors.New("missed name")
+	}
+	if k.Key == "" {
+		return errors.New("missed key")
+	}
+	if len(k.Channels) == 0 {
+		return errors.New("missed channels")
+	}
+	for _, op := range k.Operations {
+		switch op {
+		case OpPublish, OpDump, OpAdmin:
+		default:
+			return fmt.Errorf("unknown operation %q", op)
+		}
+	}
+	return nil
+}
+
+// apiKeyFromRequest returns secret from "Authorization: Bearer" header or from the token query parameter
+func apiKeyFromRequest(r *http.Request) string {
+	if s := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(s) == 2 && strings.EqualFold(s[0], "Bearer") {
+		return strings.TrimSpace(s[1])
+	}
+	return tokenFromQuery(r)
+}
+
+// requireAPIKey rejects request if api key doesn't grant the operation on channels from the url parameter,
+// empty parameter name checks the operation only. Authenticated key is stored in the request context.
+func requireAPIKey(store *KeyStore, op, param string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// request may be already authenticated by signature
+			key := apiKeyFromContext(r.Context())
+			if key == nil {
+				key = store.Authenticate(apiKeyFromRequest(r), time.Now())
+			}
+			if key == nil {
+				http.Error(w, http.StatusText(401), 401)
+				return
+			}
+			channelID := ""
+			if param != "" {
+				channelID = chi.URLParam(r, param)
+			}
+			if !key.Allows(op, channelID) {
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), key)))
+		})
+	}
+}
+
+func withAPIKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// apiKeyFromContext returns api key authenticated by requireAPIKey,
+// nil means publishers authentication is disabled
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
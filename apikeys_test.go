@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPublishHandler returns router of the server which authenticates publishers with given settings
+func newPublishHandler(t *testing.T, cfg AuthConfig) (http.Handler, *SSE) {
+	t.Helper()
+	h, sse := newTestHandler(t, NewMemStorage())
+	if cfg.SignatureWindow == 0 {
+		cfg.SignatureWindow = Duration(defaultSignatureWindow)
+	}
+	auth, err := NewAuth(cfg, h.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuth(auth)
+	return h.Router(), sse
+}
+
+func TestPublishSigned(t *testing.T) {
+	router, sse := newPublishHandler(t, AuthConfig{BasicToken: "secret"})
+	body := []byte(`{"title":"signed"}`)
+	now := time.Now()
+
+	bearer := httptest.NewRequest(http.MethodPost, "/pub/ch", strings.NewReader(`{"title":"bearer"}`))
+	bearer.Header.Set("Authorization", "Bearer secret")
+	tampered := signedRequest("secret", "/pub/ch", body, now)
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"title":"forged"}`)).Body
+	tests := []struct {
+		name     string
+		r        *http.Request
+		wantCode int
+	}{
+		{"signed", signedRequest("secret", "/pub/ch", body, now), http.StatusOK},
+		{"replayed", signedRequest("secret", "/pub/ch", body, now), http.StatusUnauthorized},
+		{"signed for another path", signedRequest("secret", "/pub/other", body, now), http.StatusOK},
+		{"tampered body", tampered, http.StatusUnauthorized},
+		{"wrong secret", signedRequest("wrong", "/pub/ch", body, now), http.StatusUnauthorized},
+		{"expired", signedRequest("secret", "/pub/ch", body, now.Add(-time.Hour)), http.StatusUnauthorized},
+		{"from the future", signedRequest("secret", "/pub/ch", body, now.Add(time.Hour)), http.StatusUnauthorized},
+		{"bearer token", bearer, http.StatusOK},
+		{"unauthenticated", httptest.NewRequest(http.MethodPost, "/pub/ch", strings.NewReader(`{}`)), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, tt.r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+
+	var titles []string
+	for _, e := range sse.DumpStorage("ch") {
+		titles = append(titles, e.Data.Title)
+	}
+	if len(titles) != 2 || titles[0] != "signed" || titles[1] != "bearer" {
+		t.Errorf("published %v, want [signed bearer]", titles)
+	}
+}
+
+func TestPublishSignatureRequired(t *testing.T) {
+	router, _ := newPublishHandler(t, AuthConfig{BasicToken: "secret", RequireSignedPublish: true})
+
+	r := httptest.NewRequest(http.MethodPost, "/pub/ch", strings.NewReader(`{}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("secret", "/pub/ch", []byte(`{}`), time.Now()))
+	if w.Code != http.StatusOK {
+		t.Errorf("signed request: status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func TestPublishKeyScope(t *testing.T) {
+	keys := writeFile(t, t.TempDir(), "keys.json", `{"keys":[
+		{"name":"news","key":"news-secret","channels":["news_*"],"operations":["publish"]}
+	]}`)
+	router, _ := newPublishHandler(t, AuthConfig{APIKeysFile: keys})
+
+	tests := []struct {
+		url      string
+		wantCode int
+	}{
+		{"/pub/news_sport", http.StatusOK},
+		{"/pub/user_1", http.StatusForbidden},
+		{"/admin/keys", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		method := http.MethodPost
+		if strings.HasPrefix(tt.url, "/admin") {
+			method = http.MethodGet
+		}
+		r := httptest.NewRequest(method, tt.url, strings.NewReader(`{}`))
+		r.Header.Set("Authorization", "Bearer news-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", tt.url, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+}
+
+func TestLegacyKeyScope(t *testing.T) {
+	keys := writeFile(t, t.TempDir(), "keys.json", `{"keys":[
+		{"name":"ops","key":"ops-secret","channels":["*"],"operations":["admin"]}
+	]}`)
+	router, _ := newPublishHandler(t, AuthConfig{BasicToken: "secret", APIKeysFile: keys})
+
+	tests := []struct {
+		method   string
+		url      string
+		key      string
+		wantCode int
+	}{
+		{http.MethodPost, "/pub/ch", "secret", http.StatusOK},
+		{http.MethodGet, "/dump/ch", "secret", http.StatusOK},
+		{http.MethodGet, "/admin/keys", "secret", http.StatusForbidden},
+		{http.MethodPost, "/admin/keys/reload", "secret", http.StatusForbidden},
+		// admin key must be listed in the keys file
+		{http.MethodGet, "/admin/keys", "ops-secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, strings.NewReader(`{}`))
+		r.Header.Set("Authorization", "Bearer "+tt.key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s with %s: status %d, want %d: %s", tt.method, tt.url, tt.key, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+}
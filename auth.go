@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Auth struct, authentication of subscribers and publishers.
+// It's replaced as a whole when configuration is reloaded.
+type Auth struct {
+	// jwt verifier of subscribers, nil if jwt authentication is disabled
+	JWT *JWTVerifier
+	// api keys of publishers, nil if publishers authentication is disabled
+	Keys *KeyStore
+	// verifier of signed publish requests, nil if signatures aren't accepted
+	Signatures *SignatureVerifier
+	// basic auth of the /listen pages, disabled if user is empty
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	jwksRefresh time.Duration
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewAuth is a factory func, builds authentication from the configuration
+func NewAuth(cfg AuthConfig, log Logger) (*Auth, error) {
+	jwtVerifier, err := NewJWTVerifierFromConfig(cfg.JWT, log)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := NewKeyStoreFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth := &Auth{
+		JWT:               jwtVerifier,
+		Keys:              keys,
+		BasicAuthUser:     cfg.BasicAuthUser,
+		BasicAuthPassword: cfg.BasicAuthPassword,
+		jwksRefresh:       time.Duration(cfg.JWT.RefreshInterval),
+		stop:              make(chan struct{}),
+	}
+	if keys != nil {
+		auth.Signatures = NewSignatureVerifier(keys, time.Duration(cfg.SignatureWindow), cfg.RequireSignedPublish)
+	}
+	return auth, nil
+}
+
+// Start runs background refresh of jwt keys
+func (a *Auth) Start(log Logger) {
+	if a.JWT != nil {
+		go a.JWT.RunKeysRefresh(a.jwksRefresh, log, a.stop)
+	}
+}
+
+// Close stops background refresh of jwt keys
+func (a *Auth) Close() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStorage struct, keeps events on disk using embedded key/value store.
+// Every channel is stored in its own bucket, events are keyed by id,
+// so the bucket is always sorted by event id.
+// Inbox states are kept in the nested buckets of the inbox bucket, one per channel.
+// Acknowledgements are kept in the acks bucket, in nested buckets of consumers in buckets of channels,
+// sequence of the consumer bucket is the id the consumer is registered with.
+// Sequence of the ids bucket is the last id used in any channel.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// names of buckets which are used by the storage itself, channels with the same names are rejected
+var (
+	boltInboxBucket = []byte("\x00inbox")
+	boltAcksBucket  = []byte("\x00acks")
+	boltIDsBucket   = []byte("\x00ids")
+)
+
+var errBoltReservedChannel = errors.New("channel name is reserved by storage")
+
+// NewBoltStorage is a factory func, opens (or creates) database file
+// and returns a new instance of the BoltStorage structure
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// Close flushes database file to disk and closes it
+func (s *BoltStorage) Close() error {
+	if err := s.db.Sync(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// GetAllInChannel returns all events in channel
+func (s *BoltStorage) GetAllInChannel(channelID string) []Event {
+	var events []Event
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if event, err := decodeEvent(v); err == nil {
+				events = append(events, event)
+			}
+			return nil
+		})
+	})
+	return events
+}
+
+// GetByLastID returns events in a channel which has id greater than given one
+func (s *BoltStorage) GetByLastID(channelID string, lastEventID int64) []Event {
+	var events []Event
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(boltKey(lastEventID + 1)); k != nil; k, v = c.Next() {
+			if event, err := decodeEvent(v); err == nil {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events
+}
+
+// GetLast returns the most recent events in a channel, up to given number
+func (s *BoltStorage) GetLast(channelID string, n int) ([]Event, error) {
+	var events []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(events) < n; k, v = c.Prev() {
+			if event, err := decodeEvent(v); err == nil {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// events have been read from the newest to the oldest
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// GetSince returns events in a channel which have been published at or after given time
+func (s *BoltStorage) GetSince(channelID string, since time.Time) ([]Event, error) {
+	t := since.UnixNano()
+	var events []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(boltKey(t)); k != nil; k, v = c.Next() {
+			if event, err := decodeEvent(v); err == nil {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return publishedSince(events, t), nil
+}
+
+// GetPage returns page of events in a channel
+func (s *BoltStorage) GetPage(channelID string, query PageQuery) ([]Event, error) {
+	if query.Limit <= 0 {
+		return nil, nil
+	}
+	var events []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		inRange := func(k []byte) bool {
+			if len(k) != 8 || len(events) >= query.Limit {
+				return false
+			}
+			id := int64(binary.BigEndian.Uint64(k))
+			return id > query.AfterID && (query.BeforeID <= 0 || id < query.BeforeID)
+		}
+
+		if !query.Descending {
+			for k, v := c.Seek(boltKey(query.AfterID + 1)); inRange(k); k, v = c.Next() {
+				if event, err := decodeEvent(v); err == nil {
+					events = append(events, event)
+				}
+			}
+			return nil
+		}
+
+		// start from the last event before the upper bound
+		k, v := c.Last()
+		if query.BeforeID > 0 {
+			if k, v = c.Seek(boltKey(query.BeforeID)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; inRange(k); k, v = c.Prev() {
+			if event, err := decodeEvent(v); err == nil {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// NextID returns the next id of event in a channel,
+// the sequence is shared by all channels and kept in the ids bucket
+func (s *BoltStorage) NextID(channelID string, now int64) (int64, error) {
+	if boltReserved([]byte(channelID)) {
+		return 0, errBoltReservedChannel
+	}
+	var id int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltIDsBucket)
+		if err != nil {
+			return err
+		}
+		lastID := int64(b.Sequence())
+		if lastID == 0 {
+			// database of the previous version keeps the last id in the sequence of every channel bucket
+			err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if seq := int64(b.Sequence()); !boltReserved(name) && seq > lastID {
+					lastID = seq
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		id = nextEventID(lastID, now)
+		return b.SetSequence(uint64(id))
+	})
+	return id, err
+}
+
+// Add event to storage
+func (s *BoltStorage) Add(channelID string, event Event) error {
+	if boltReserved([]byte(channelID)) {
+		return errBoltReservedChannel
+	}
+	v, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(channelID))
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(event.ID), v)
+	})
+}
+
+// Delete event from storage
+func (s *BoltStorage) Delete(channelID string, event Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if states := boltInboxStates(tx, channelID); states != nil {
+			if err := states.Delete(boltKey(event.ID)); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket([]byte(channelID))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(boltKey(event.ID))
+	})
+}
+
+// SetInboxState sets state of events in a channel, unread state isn't stored
+func (s *BoltStorage) SetInboxState(channelID string, ids []int64, state InboxState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if state == InboxUnread {
+			states := boltInboxStates(tx, channelID)
+			if states == nil {
+				return nil
+			}
+			for _, id := range ids {
+				if err := states.Delete(boltKey(id)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		inbox, err := tx.CreateBucketIfNotExists(boltInboxBucket)
+		if err != nil {
+			return err
+		}
+		states, err := inbox.CreateBucketIfNotExists([]byte(channelID))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := states.Put(boltKey(id), []byte(state)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetInboxStates returns states of events in a channel which aren't unread
+func (s *BoltStorage) GetInboxStates(channelID string) (map[int64]InboxState, error) {
+	res := make(map[int64]InboxState)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		states := boltInboxStates(tx, channelID)
+		if states == nil {
+			return nil
+		}
+		return states.ForEach(func(k, v []byte) error {
+			res[int64(binary.BigEndian.Uint64(k))] = InboxState(v)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// RegisterConsumer starts tracking of acknowledgements of the consumer in a channel
+func (s *BoltStorage) RegisterConsumer(channelID, consumerID string, from int64) (int64, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := boltCreateConsumer(tx, channelID, consumerID)
+		if err != nil {
+			return err
+		}
+		if b.Sequence() == 0 {
+			return b.SetSequence(uint64(from))
+		}
+		from = int64(b.Sequence())
+		return nil
+	})
+	return from, err
+}
+
+// Ack records acknowledgements of events by the consumer registered in the channel
+func (s *BoltStorage) Ack(channelID, consumerID string, ids []int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := boltConsumer(tx, channelID, consumerID)
+		if b == nil {
+			return ErrConsumerNotRegistered
+		}
+		for _, id := range ids {
+			if err := b.Put(boltKey(id), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAckState returns acknowledgements of the consumer in a channel
+func (s *BoltStorage) GetAckState(channelID, consumerID string) (AckState, error) {
+	res := AckState{Acked: make(map[int64]bool)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := boltConsumer(tx, channelID, consumerID)
+		if b == nil {
+			return nil
+		}
+		res.From = int64(b.Sequence())
+		return b.ForEach(func(k, _ []byte) error {
+			res.Acked[int64(binary.BigEndian.Uint64(k))] = true
+			return nil
+		})
+	})
+	return res, err
+}
+
+// GC - garbage collector, it runs until stop is closed
+func (s *BoltStorage) GC(maxAge, period time.Duration, active ActiveConsumers, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			collectGarbage(s.gc, maxAge, active)
+		}
+	}
+}
+
+// Stats returns number of channels and events in storage
+func (s *BoltStorage) Stats() (StorageStats, error) {
+	stats := StorageStats{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if boltReserved(name) {
+				return nil
+			}
+			stats.Channels++
+			stats.Events += b.Stats().KeyN
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// gc deletes expired events, returns number of deleted events
+func (s *BoltStorage) gc(maxAge time.Duration, active ActiveConsumers) (int, error) {
+	t := time.Now().UnixNano() - maxAge.Nanoseconds()
+	bound := boltKey(t)
+
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var empty [][]byte
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if boltReserved(name) {
+				return nil
+			}
+			n, err := boltDeleteBefore(b, bound)
+			if err != nil {
+				return err
+			}
+			removed += n
+			if k, _ := b.Cursor().First(); k == nil {
+				empty = append(empty, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range empty {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+
+		// acknowledgements of removed events are removed as well
+		if err := boltPruneAcks(tx, bound, active); err != nil {
+			return err
+		}
+
+		// states of removed events are removed as well
+		inbox := tx.Bucket(boltInboxBucket)
+		if inbox == nil {
+			return nil
+		}
+		empty = nil
+		err = inbox.ForEach(func(name, _ []byte) error {
+			states := inbox.Bucket(name)
+			if _, err := boltDeleteBefore(states, bound); err != nil {
+				return err
+			}
+			if k, _ := states.Cursor().First(); k == nil {
+				empty = append(empty, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range empty {
+			if err := inbox.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// transaction has been rolled back
+		return 0, err
+	}
+	return removed, nil
+}
+
+// boltDeleteBefore deletes items of the bucket with keys less than bound, returns number of deleted items
+func boltDeleteBefore(b *bolt.Bucket, bound []byte) (int, error) {
+	// collect keys first, deleting under the cursor skips items
+	var expired [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, bound) < 0; k, _ = c.Next() {
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// boltPruneAcks deletes acknowledgements of events which keys are less than bound,
+// consumers of channels without events which have been registered before bound are forgotten,
+// active consumers are skipped
+func boltPruneAcks(tx *bolt.Tx, bound []byte, active ActiveConsumers) error {
+	acks := tx.Bucket(boltAcksBucket)
+	if acks == nil {
+		return nil
+	}
+	t := binary.BigEndian.Uint64(bound)
+	var removed [][]byte
+	err := acks.ForEach(func(name, _ []byte) error {
+		consumers := acks.Bucket(name)
+		empty := tx.Bucket(name) == nil
+		var forgotten [][]byte
+		err := consumers.ForEach(func(consumerID, _ []byte) error {
+			if active.has(string(name), string(consumerID)) {
+				return nil
+			}
+			b := consumers.Bucket(consumerID)
+			if empty && b.Sequence() < t {
+				forgotten = append(forgotten, append([]byte(nil), consumerID...))
+				return nil
+			}
+			if _, err := boltDeleteBefore(b, bound); err != nil {
+				return err
+			}
+			if seq := b.Sequence(); seq != 0 && seq < t {
+				return b.SetSequence(t)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, consumerID := range forgotten {
+			if err := consumers.DeleteBucket(consumerID); err != nil {
+				return err
+			}
+		}
+		if k, _ := consumers.Cursor().First(); k == nil {
+			removed = append(removed, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range removed {
+		if err := acks.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltCreateConsumer returns bucket of acknowledgements of the consumer, it's created if it doesn't exist
+func boltCreateConsumer(tx *bolt.Tx, channelID, consumerID string) (*bolt.Bucket, error) {
+	acks, err := tx.CreateBucketIfNotExists(boltAcksBucket)
+	if err != nil {
+		return nil, err
+	}
+	consumers, err := acks.CreateBucketIfNotExists([]byte(channelID))
+	if err != nil {
+		return nil, err
+	}
+	return consumers.CreateBucketIfNotExists([]byte(consumerID))
+}
+
+// boltConsumer returns bucket of acknowledgements of the consumer, nil if the consumer isn't registered
+func boltConsumer(tx *bolt.Tx, channelID, consumerID string) *bolt.Bucket {
+	acks := tx.Bucket(boltAcksBucket)
+	if acks == nil {
+		return nil
+	}
+	consumers := acks.Bucket([]byte(channelID))
+	if consumers == nil {
+		return nil
+	}
+	return consumers.Bucket([]byte(consumerID))
+}
+
+// boltReserved reports whether the bucket is used by the storage itself, not by a channel
+func boltReserved(name []byte) bool {
+	return bytes.Equal(name, boltInboxBucket) || bytes.Equal(name, boltAcksBucket) || bytes.Equal(name, boltIDsBucket)
+}
+
+// boltInboxStates returns bucket of inbox states of a channel, nil if there are no states
+func boltInboxStates(tx *bolt.Tx, channelID string) *bolt.Bucket {
+	inbox := tx.Bucket(boltInboxBucket)
+	if inbox == nil {
+		return nil
+	}
+	return inbox.Bucket([]byte(channelID))
+}
+
+// boltKey converts event id to the bucket key,
+// big endian encoding keeps keys sorted in the same order as ids
+func boltKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
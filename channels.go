@@ -1,61 +1,193 @@
 package main
 
 import (
+	"context"
 	"strings"
-
-	"github.com/dustin/go-broadcast"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var channels = make(map[string]broadcast.Broadcaster)
+type (
+	// Relay delivers published events to the listeners of the channel
+	Relay interface {
+		Publish(channelID string, event Event) error
+	}
 
-func openListener(channelID string) chan interface{} {
-	listener := make(chan interface{})
-	channel(channelID).Register(listener)
-	return listener
+	// localRelay delivers events to the listeners of the current process only
+	localRelay struct {
+		hub *Hub
+	}
+
+	// Hub is a registry of channel subscribers, it's safe for concurrent use.
+	// Channel is registered on its first subscriber
+	// and removed as soon as the last subscriber has left.
+	Hub struct {
+		sync.RWMutex
+		channels       map[string]map[*Subscriber]struct{}
+		queueSize      int
+		overflowPolicy OverflowPolicy
+		dropped        uint64
+		evicted        uint64
+		// closed when the server is shutting down
+		done         chan struct{}
+		shutdownOnce sync.Once
+		onSubmit     func(channelID string, event interface{})
+	}
+)
+
+// NewLocalRelay returns relay which submits events to the local hub
+func NewLocalRelay(hub *Hub) Relay {
+	return localRelay{hub: hub}
 }
 
-func closeListener(channelID string, listener chan interface{}) {
-	channel(channelID).Unregister(listener)
-	close(listener)
+// Publish event to the channel
+func (r localRelay) Publish(channelID string, event Event) error {
+	r.hub.Submit(channelID, event)
+	return nil
 }
 
-func closeMultiListener(channels []string, listener chan interface{}) {
-	for _, channelID := range channels {
-		channel(channelID).Unregister(listener)
+// NewHub is a factory func, returns a new instance of the Hub structure.
+// Every subscriber gets a queue of queueSize events, overflowPolicy is applied when it's full.
+func NewHub(queueSize int, overflowPolicy OverflowPolicy) *Hub {
+	return &Hub{
+		channels:       make(map[string]map[*Subscriber]struct{}),
+		queueSize:      queueSize,
+		overflowPolicy: overflowPolicy,
+		done:           make(chan struct{}),
 	}
-	close(listener)
 }
 
-func openMultiChannelListener(channels []string) chan interface{} {
-	listener := make(chan interface{})
+// Open returns a new subscriber of the channel
+func (h *Hub) Open(channelID string) *Subscriber {
+	return h.OpenMulti([]string{channelID})
+}
+
+// OpenMulti returns a new subscriber of all given channels
+func (h *Hub) OpenMulti(channels []string) *Subscriber {
+	sub := NewSubscriber(h.queueSize, h.overflowPolicy)
+
+	h.Lock()
+	defer h.Unlock()
+
 	for _, channelID := range channels {
-		channel(channelID).Register(listener)
+		channelID = strings.ToLower(channelID)
+		subs, ok := h.channels[channelID]
+		if !ok {
+			subs = make(map[*Subscriber]struct{})
+			h.channels[channelID] = subs
+		}
+		subs[sub] = struct{}{}
 	}
-	return listener
+	return sub
+}
+
+// Close unregisters the subscriber from the channel
+func (h *Hub) Close(channelID string, sub *Subscriber) {
+	h.CloseMulti([]string{channelID}, sub)
 }
 
-func closeMultiChannelListener(channels []string, listener chan interface{}) {
+// CloseMulti unregisters the subscriber from all given channels
+func (h *Hub) CloseMulti(channels []string, sub *Subscriber) {
+	h.Lock()
+	defer h.Unlock()
+
 	for _, channelID := range channels {
-		channel(channelID).Unregister(listener)
+		channelID = strings.ToLower(channelID)
+		subs, ok := h.channels[channelID]
+		if !ok {
+			continue
+		}
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(h.channels, channelID)
+		}
 	}
-	close(listener)
 }
 
-func deleteBroadcast(channelID string) {
+// OnSubmit sets func which is called with every event submitted to a channel which has subscribers
+func (h *Hub) OnSubmit(f func(channelID string, event interface{})) {
+	h.Lock()
+	defer h.Unlock()
+	h.onSubmit = f
+}
+
+// Submit sends event to all subscribers of the channel without blocking,
+// it does nothing if nobody listens to the channel
+func (h *Hub) Submit(channelID string, event interface{}) {
 	channelID = strings.ToLower(channelID)
-	b, ok := channels[channelID]
-	if ok {
-		b.Close()
-		delete(channels, channelID)
+
+	h.RLock()
+	defer h.RUnlock()
+
+	subs := h.channels[channelID]
+	if len(subs) == 0 {
+		return
+	}
+	if h.onSubmit != nil {
+		h.onSubmit(channelID, event)
+	}
+	prefix := channelPrefix(channelID)
+	delivered, dropped := 0, 0
+	for sub := range subs {
+		ok, evicted := sub.offer(event)
+		if ok {
+			delivered++
+		} else {
+			dropped++
+			atomic.AddUint64(&h.dropped, 1)
+		}
+		if evicted {
+			atomic.AddUint64(&h.evicted, 1)
+			evictedSubscribersCounter.Inc()
+		}
+	}
+	deliveredCounter.WithLabelValues(prefix).Add(float64(delivered))
+	if dropped > 0 {
+		droppedCounter.WithLabelValues(prefix).Add(float64(dropped))
 	}
 }
 
-func channel(channelID string) broadcast.Broadcaster {
-	channelID = strings.ToLower(channelID)
-	b, ok := channels[channelID]
-	if !ok {
-		b = broadcast.NewBroadcaster(10)
-		channels[channelID] = b
+// Shutdown tells all subscribers that the server is shutting down, see Done
+func (h *Hub) Shutdown() {
+	h.shutdownOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// Done returns channel which is closed when the server is shutting down,
+// subscribers are expected to say goodbye to their clients and leave
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until all subscribers have left or the context is done
+func (h *Hub) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for h.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	return b
+	return nil
+}
+
+// Len returns number of channels which have at least one subscriber
+func (h *Hub) Len() int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.channels)
+}
+
+// Dropped returns total number of events which have not been delivered to slow subscribers
+func (h *Hub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Evicted returns total number of slow subscribers disconnected by overflow policy
+func (h *Hub) Evicted() uint64 {
+	return atomic.LoadUint64(&h.evicted)
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Config is the configuration of the server. It's loaded from yaml file,
+	// then every field which has "env" tag is overridden by the environment variable if it's set,
+	// or by content of the file named by the variable with "_FILE" suffix, e.g. JWT_SECRET_FILE,
+	// so the setting can be changed by reload in deployments configured by environment.
+	// Fields tagged with `secret:"true"` are redacted when configuration is printed.
+	Config struct {
+		Port            string        `yaml:"port" env:"APP_PORT"`
+		ShutdownTimeout Duration      `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+		TLS             TLSConfig     `yaml:"tls"`
+		Log             LogConfig     `yaml:"log"`
+		CORS            CORSConfig    `yaml:"cors"`
+		Auth            AuthConfig    `yaml:"auth"`
+		Storage         StorageConfig `yaml:"storage"`
+		GC              GCConfig      `yaml:"gc"`
+		Limits          LimitsConfig  `yaml:"limits"`
+		Stream          StreamConfig  `yaml:"stream"`
+		Metrics         MetricsConfig `yaml:"metrics"`
+	}
+
+	// TLSConfig struct
+	TLSConfig struct {
+		// certificate and key files are reloaded when they are changed
+		CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+		KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+		// serve http/2 over cleartext connections, e.g. behind tls terminating proxy
+		H2C bool `yaml:"h2c" env:"H2C"`
+	}
+
+	// LogConfig struct
+	LogConfig struct {
+		Level  string `yaml:"level" env:"LOG_LEVEL"`
+		Format string `yaml:"format" env:"LOG_FORMAT"`
+	}
+
+	// CORSConfig struct
+	CORSConfig struct {
+		AllowedOrigins []string `yaml:"allowed_origins" env:"ALLOWED_ORIGINS"`
+	}
+
+	// AuthConfig struct
+	AuthConfig struct {
+		// basic auth of the /listen pages
+		BasicAuthUser     string `yaml:"basic_auth_user" env:"BASIC_AUTH_USER"`
+		BasicAuthPassword string `yaml:"basic_auth_password" env:"BASIC_AUTH_PASSWORD" secret:"true"`
+		// legacy publisher token, it's granted all operations on all channels
+		BasicToken           string    `yaml:"basic_token" env:"BASIC_TOKEN" secret:"true"`
+		APIKeysFile          string    `yaml:"api_keys_file" env:"API_KEYS_FILE"`
+		RequireSignedPublish bool      `yaml:"require_signed_publish" env:"REQUIRE_SIGNED_PUBLISH"`
+		SignatureWindow      Duration  `yaml:"signature_window" env:"SIGNATURE_WINDOW"`
+		JWT                  JWTConfig `yaml:"jwt"`
+	}
+
+	// JWTConfig struct
+	JWTConfig struct {
+		Secret          string   `yaml:"secret" env:"JWT_SECRET" secret:"true"`
+		PublicKeyFile   string   `yaml:"public_key_file" env:"JWT_PUBLIC_KEY_FILE"`
+		KeyID           string   `yaml:"key_id" env:"JWT_KEY_ID"`
+		JWKSURL         string   `yaml:"jwks_url" env:"JWKS_URL"`
+		JWKSFile        string   `yaml:"jwks_file" env:"JWKS_FILE"`
+		RefreshInterval Duration `yaml:"jwks_refresh_interval" env:"JWKS_REFRESH_INTERVAL"`
+		Algorithms      []string `yaml:"algorithms" env:"JWT_ALGORITHMS"`
+		// channels granted to the subject, e.g.: "user_notifications_{sub},news_*"
+		ChannelTemplate string `yaml:"channel_template" env:"JWT_CHANNEL_TEMPLATE"`
+		// tokens must have these "iss" and "aud" claims, if they are set
+		Issuer   string `yaml:"issuer" env:"JWT_ISSUER"`
+		Audience string `yaml:"audience" env:"JWT_AUDIENCE"`
+	}
+
+	// StorageConfig struct
+	StorageConfig struct {
+		Driver      string `yaml:"driver" env:"STORAGE_DRIVER"`
+		BoltPath    string `yaml:"bolt_path" env:"BOLT_PATH"`
+		RedisURL    string `yaml:"redis_url" env:"REDIS_URL" secret:"url"`
+		RedisPrefix string `yaml:"redis_prefix" env:"REDIS_PREFIX"`
+	}
+
+	// GCConfig struct
+	GCConfig struct {
+		// events older than max age are removed from storage
+		MaxAge Duration `yaml:"max_age" env:"SSE_MAX_AGE"`
+		Period Duration `yaml:"period" env:"GC_PERIOD"`
+	}
+
+	// LimitsConfig struct
+	LimitsConfig struct {
+		SubscriberQueueSize      int    `yaml:"subscriber_queue_size" env:"SUBSCRIBER_QUEUE_SIZE"`
+		SubscriberOverflowPolicy string `yaml:"subscriber_overflow_policy" env:"SUBSCRIBER_OVERFLOW_POLICY"`
+	}
+
+	// StreamConfig struct, settings of the server-sent events streams
+	StreamConfig struct {
+		// comment is sent to the stream with this interval, so idle connections aren't closed by proxies,
+		// zero disables heartbeats
+		HeartbeatInterval Duration `yaml:"heartbeat_interval" env:"HEARTBEAT_INTERVAL"`
+		// bounds of the heartbeat interval requested by client with the "heartbeat" query parameter
+		MinHeartbeatInterval Duration `yaml:"min_heartbeat_interval" env:"MIN_HEARTBEAT_INTERVAL"`
+		MaxHeartbeatInterval Duration `yaml:"max_heartbeat_interval" env:"MAX_HEARTBEAT_INTERVAL"`
+		// reconnection delay hint sent on connect, zero keeps the client default
+		Retry Duration `yaml:"retry" env:"SSE_RETRY"`
+		// overrides by route prefix, e.g. "/sub" or "/listen/multi"
+		Routes map[string]RouteStreamConfig `yaml:"routes"`
+	}
+
+	// RouteStreamConfig struct, overrides stream settings of a route, missed settings are inherited
+	RouteStreamConfig struct {
+		HeartbeatInterval *Duration `yaml:"heartbeat_interval,omitempty"`
+		Retry             *Duration `yaml:"retry,omitempty"`
+	}
+
+	// MetricsConfig struct
+	MetricsConfig struct {
+		// prefixes of channel ids which are used as labels of per-channel metrics, e.g.: "user_,news_",
+		// events of other channels are counted with the "other" label
+		ChannelPrefixes []string `yaml:"channel_prefixes" env:"METRICS_CHANNEL_PREFIXES"`
+	}
+
+	// Duration is a time.Duration which is written as a string, e.g.: 1h30m
+	Duration time.Duration
+)
+
+const redactedValue = "*****"
+
+// suffix of environment variables which name files with values of settings
+const envFileSuffix = "_FILE"
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// DefaultConfig returns configuration which is used for settings missed in the file and environment
+func DefaultConfig() Config {
+	return Config{
+		Port:            "8080",
+		ShutdownTimeout: Duration(defaultShutdownTimeout),
+		Log: LogConfig{
+			Level:  "info",
+			Format: LogFormatJSON,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+		},
+		Auth: AuthConfig{
+			SignatureWindow: Duration(defaultSignatureWindow),
+			JWT: JWTConfig{
+				RefreshInterval: Duration(defaultJWKSRefreshInterval),
+			},
+		},
+		Storage: StorageConfig{
+			Driver:      "memory",
+			BoltPath:    "notifications.db",
+			RedisPrefix: "sse:",
+		},
+		GC: GCConfig{
+			MaxAge: Duration(time.Hour),
+			Period: Duration(time.Hour),
+		},
+		Limits: LimitsConfig{
+			SubscriberQueueSize:      defaultQueueSize,
+			SubscriberOverflowPolicy: string(defaultOverflowPolicy),
+		},
+		Stream: StreamConfig{
+			HeartbeatInterval:    Duration(defaultHeartbeatInterval),
+			MinHeartbeatInterval: Duration(minHeartbeatInterval),
+			MaxHeartbeatInterval: Duration(maxHeartbeatInterval),
+			Retry:                Duration(defaultRetry),
+		},
+	}
+}
+
+// LoadConfig reads configuration from the yaml file, if path isn't empty,
+// applies environment overrides and validates the result
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("parse config file %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Validate checks configuration, returns all found problems at once
+func (c Config) Validate() error {
+	var errs []string
+	fail := func(format string, v ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, v...))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 0 || port > 65535 {
+		fail("port: %q is not a valid port number", c.Port)
+	}
+	if c.ShutdownTimeout <= 0 {
+		fail("shutdown_timeout: must be positive")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls: cert_file and key_file must be set together")
+	}
+	if c.TLS.H2C && c.TLS.Enabled() {
+		fail("tls.h2c: can't be used together with tls")
+	}
+	if _, err := ParseLevel(c.Log.Level); err != nil {
+		fail("log.level: %v", err)
+	}
+	switch c.Log.Format {
+	case "", LogFormatJSON, LogFormatText:
+	default:
+		fail("log.format: must be %q or %q", LogFormatJSON, LogFormatText)
+	}
+	if len(c.CORS.AllowedOrigins) == 0 {
+		fail("cors.allowed_origins: must not be empty, use \"*\" to allow any origin")
+	}
+
+	if (c.Auth.BasicAuthUser == "") != (c.Auth.BasicAuthPassword == "") {
+		fail("auth: basic_auth_user and basic_auth_password must be set together")
+	}
+	if c.Auth.RequireSignedPublish && c.Auth.APIKeysFile == "" && c.Auth.BasicToken == "" {
+		fail("auth.require_signed_publish: api_keys_file or basic_token must be set")
+	}
+	if c.Auth.SignatureWindow <= 0 {
+		fail("auth.signature_window: must be positive")
+	}
+	if c.Auth.JWT.JWKSURL != "" && c.Auth.JWT.JWKSFile != "" {
+		fail("auth.jwt: only one of jwks_url and jwks_file may be set")
+	}
+	if c.Auth.JWT.RefreshInterval <= 0 {
+		fail("auth.jwt.jwks_refresh_interval: must be positive")
+	}
+	if c.Auth.JWT.ChannelTemplate != "" && !c.Auth.JWT.Enabled() {
+		fail("auth.jwt.channel_template: jwt authentication isn't configured")
+	}
+	if (c.Auth.JWT.Issuer != "" || c.Auth.JWT.Audience != "") && !c.Auth.JWT.Enabled() {
+		fail("auth.jwt: issuer and audience require jwt authentication")
+	}
+
+	switch c.Storage.Driver {
+	case "memory":
+	case "bolt":
+		if c.Storage.BoltPath == "" {
+			fail("storage.bolt_path: must be set for bolt storage")
+		}
+	case "redis":
+		if c.Storage.RedisURL == "" {
+			fail("storage.redis_url: must be set for redis storage")
+		}
+	default:
+		fail("storage.driver: unsupported storage driver %q, expected memory, bolt or redis", c.Storage.Driver)
+	}
+
+	if c.GC.MaxAge <= 0 {
+		fail("gc.max_age: must be positive")
+	}
+	if c.GC.Period <= 0 {
+		fail("gc.period: must be positive")
+	}
+
+	if c.Limits.SubscriberQueueSize < 1 {
+		fail("limits.subscriber_queue_size: must be at least 1")
+	}
+	if _, err := ParseOverflowPolicy(c.Limits.SubscriberOverflowPolicy); err != nil {
+		fail("limits.subscriber_overflow_policy: %v", err)
+	}
+
+	if c.Stream.HeartbeatInterval < 0 {
+		fail("stream.heartbeat_interval: must not be negative")
+	}
+	if c.Stream.MinHeartbeatInterval <= 0 {
+		fail("stream.min_heartbeat_interval: must be positive")
+	}
+	if c.Stream.MaxHeartbeatInterval < c.Stream.MinHeartbeatInterval {
+		fail("stream.max_heartbeat_interval: must not be less than min_heartbeat_interval")
+	}
+	if c.Stream.Retry < 0 {
+		fail("stream.retry: must not be negative")
+	}
+	prefixes := make([]string, 0, len(c.Stream.Routes))
+	for prefix := range c.Stream.Routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		route := c.Stream.Routes[prefix]
+		if !strings.HasPrefix(prefix, "/") {
+			fail("stream.routes: route %q must start with /", prefix)
+		}
+		if route.HeartbeatInterval != nil && *route.HeartbeatInterval < 0 {
+			fail("stream.routes.%s.heartbeat_interval: must not be negative", prefix)
+		}
+		if route.Retry != nil && *route.Retry < 0 {
+			fail("stream.routes.%s.retry: must not be negative", prefix)
+		}
+	}
+
+	for _, prefix := range c.Metrics.ChannelPrefixes {
+		if prefix == "" || prefix != strings.ToLower(prefix) {
+			fail("metrics.channel_prefixes: prefix %q must not be empty and must be lower case like channel ids", prefix)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// Redacted returns yaml representation of the configuration with secrets hidden
+func (c Config) Redacted() ([]byte, error) {
+	redactSecrets(reflect.ValueOf(&c).Elem())
+	return yaml.Marshal(c)
+}
+
+// Enabled reports whether the server is served over tls
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Enabled reports whether jwt authentication is configured
+func (c JWTConfig) Enabled() bool {
+	return c.Secret != "" || c.PublicKeyFile != "" || c.JWKSURL != "" || c.JWKSFile != ""
+}
+
+// Enabled reports whether publishers authentication is configured
+func (c AuthConfig) Enabled() bool {
+	return c.APIKeysFile != "" || c.BasicToken != ""
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// applyEnv overrides fields tagged with "env" by values of environment variables
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, f := t.Field(i), v.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			if f.Kind() == reflect.Struct {
+				if err := applyEnv(f, lookup); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		s, _ := lookup(name)
+		if path, _ := lookup(name + envFileSuffix); path != "" {
+			if s != "" {
+				return fmt.Errorf("environment variables %s and %s%s can't be set together", name, name, envFileSuffix)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("environment variable %s%s: %v", name, envFileSuffix, err)
+			}
+			s = strings.TrimRight(string(b), "\r\n")
+		}
+		if s == "" {
+			continue
+		}
+		if err := setField(f, s); err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// envVars returns names of set environment variables which override fields tagged with "env",
+// suffix selects variables which name files with values, see applyEnv
+func envVars(t reflect.Type, suffix string, lookup func(string) (string, bool)) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			if field.Type.Kind() == reflect.Struct {
+				names = append(names, envVars(field.Type, suffix, lookup)...)
+			}
+			continue
+		}
+		if s, _ := lookup(name + suffix); s != "" {
+			names = append(names, name+suffix)
+		}
+	}
+	return names
+}
+
+func setField(f reflect.Value, s string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// redactSecrets hides values of fields tagged as secret,
+// password is hidden in urls tagged as `secret:"url"`
+func redactSecrets(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, f := t.Field(i), v.Field(i)
+		switch field.Tag.Get("secret") {
+		case "true":
+			if f.String() != "" {
+				f.SetString(redactedValue)
+			}
+		case "url":
+			if u, err := url.Parse(f.String()); err == nil {
+				f.SetString(u.Redacted())
+			} else {
+				f.SetString(redactedValue)
+			}
+		default:
+			if f.Kind() == reflect.Struct {
+				redactSecrets(f)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes the content to a new file in the test directory and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyEnvFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := writeFile(t, dir, "secret", "s3cret\n")
+	origins := writeFile(t, dir, "origins", "https://a.example,https://b.example")
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    func(cfg Config) bool
+		wantErr string
+	}{
+		{
+			name: "value from file without trailing newline",
+			env:  map[string]string{"JWT_SECRET_FILE": secret, "ALLOWED_ORIGINS_FILE": origins},
+			want: func(cfg Config) bool {
+				return cfg.Auth.JWT.Secret == "s3cret" &&
+					reflect.DeepEqual(cfg.CORS.AllowedOrigins, []string{"https://a.example", "https://b.example"})
+			},
+		},
+		{
+			name: "value from variable",
+			env:  map[string]string{"JWT_SECRET": "plain"},
+			want: func(cfg Config) bool { return cfg.Auth.JWT.Secret == "plain" },
+		},
+		{
+			name:    "both variables",
+			env:     map[string]string{"JWT_SECRET": "plain", "JWT_SECRET_FILE": secret},
+			wantErr: "can't be set together",
+		},
+		{
+			name:    "missing file",
+			env:     map[string]string{"BASIC_TOKEN_FILE": filepath.Join(dir, "nope")},
+			wantErr: "BASIC_TOKEN_FILE",
+		},
+	}
+	for _, tt := range tests {
+		lookup := func(name string) (string, bool) {
+			v, ok := tt.env[name]
+			return v, ok
+		}
+		cfg := DefaultConfig()
+		err := applyEnv(reflect.ValueOf(&cfg).Elem(), lookup)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.want(cfg) {
+			t.Errorf("%s: unexpected config %+v", tt.name, cfg)
+		}
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	env := map[string]string{"JWT_SECRET_FILE": "/run/secrets/jwt", "ALLOWED_ORIGINS": "*", "UNKNOWN_FILE": "x"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	if got := envVars(reflect.TypeOf(Config{}), envFileSuffix, lookup); !reflect.DeepEqual(got, []string{"JWT_SECRET_FILE"}) {
+		t.Errorf("file variables: got %v", got)
+	}
+	if got := envVars(reflect.TypeOf(Config{}), "", lookup); !reflect.DeepEqual(got, []string{"ALLOWED_ORIGINS"}) {
+		t.Errorf("variables: got %v", got)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", `
+port: "9090"
+auth:
+  jwt:
+    secret: s3cret
+storage:
+  driver: redis
+  redis_url: redis://:password@localhost:6379/0
+gc:
+  max_age: 30m
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9090" || cfg.Auth.JWT.Secret != "s3cret" || cfg.Storage.Driver != "redis" ||
+		cfg.GC.MaxAge != Duration(30*time.Minute) {
+		t.Errorf("settings from file aren't applied: %+v", cfg)
+	}
+	// settings missed in the file are defaults
+	if cfg.GC.Period != DefaultConfig().GC.Period || cfg.Limits != DefaultConfig().Limits {
+		t.Errorf("defaults aren't applied: %+v", cfg)
+	}
+
+	b, err := cfg.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cret") || strings.Contains(string(b), ":password@") {
+		t.Errorf("secrets aren't redacted:\n%s", b)
+	}
+
+	if _, err := LoadConfig(writeFile(t, dir, "unknown.yaml", "prot: 9090\n")); err == nil {
+		t.Error("unknown setting hasn't been rejected")
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "nope.yaml")); err == nil {
+		t.Error("missing file hasn't been rejected")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		wantErr string
+	}{
+		{"default", func(cfg *Config) {}, ""},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "loud" }, "log.level"},
+		{"log format", func(cfg *Config) { cfg.Log.Format = "xml" }, "log.format"},
+		{"no origins", func(cfg *Config) { cfg.CORS.AllowedOrigins = nil }, "cors.allowed_origins"},
+		{"basic auth without password", func(cfg *Config) { cfg.Auth.BasicAuthUser = "admin" }, "basic_auth_password"},
+		{"signatures without keys", func(cfg *Config) { cfg.Auth.RequireSignedPublish = true }, "auth.require_signed_publish"},
+		{"both jwks sources", func(cfg *Config) {
+			cfg.Auth.JWT.JWKSURL, cfg.Auth.JWT.JWKSFile = "https://example.com/jwks", "jwks.json"
+		}, "auth.jwt"},
+		{"channel template without jwt", func(cfg *Config) { cfg.Auth.JWT.ChannelTemplate = "user_{sub}" }, "auth.jwt.channel_template"},
+		{"audience without jwt", func(cfg *Config) { cfg.Auth.JWT.Audience = "notifications" }, "auth.jwt"},
+		{"storage driver", func(cfg *Config) { cfg.Storage.Driver = "mysql" }, "storage.driver"},
+		{"redis without url", func(cfg *Config) { cfg.Storage.Driver = "redis" }, "storage.redis_url"},
+		{"gc period", func(cfg *Config) { cfg.GC.Period = 0 }, "gc.period"},
+		{"queue size", func(cfg *Config) { cfg.Limits.SubscriberQueueSize = 0 }, "limits.subscriber_queue_size"},
+		{"overflow policy", func(cfg *Config) { cfg.Limits.SubscriberOverflowPolicy = "block" }, "limits.subscriber_overflow_policy"},
+		{"heartbeat bounds", func(cfg *Config) {
+			cfg.Stream.MaxHeartbeatInterval = cfg.Stream.MinHeartbeatInterval - 1
+		}, "stream.max_heartbeat_interval"},
+		{"route", func(cfg *Config) { cfg.Stream.Routes = map[string]RouteStreamConfig{"sub": {}} }, "stream.routes"},
+		{"metrics prefix", func(cfg *Config) { cfg.Metrics.ChannelPrefixes = []string{"User_"} }, "metrics.channel_prefixes"},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		tt.change(&cfg)
+		err := cfg.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// all problems are reported at once
+	cfg := DefaultConfig()
+	cfg.GC.MaxAge, cfg.GC.Period = 0, 0
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "gc.max_age") || !strings.Contains(err.Error(), "gc.period") {
+		t.Errorf("got error %v, want both gc settings", err)
+	}
+}
@@ -1,17 +1,21 @@
 module notification-server
 
-go 1.12
+go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
-	github.com/dustin/go-broadcast v0.0.0-20171205050544-f664265f5a66
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gin-contrib/sse v0.1.0
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-chi/cors v1.0.0
 	github.com/go-chi/jwtauth v3.3.0+incompatible
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/gorilla/websocket v1.4.1
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	github.com/satori/go.uuid v1.2.0
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
-	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// idle load balancers usually close connections in 60s
+	defaultHeartbeatInterval = 30 * time.Second
+	minHeartbeatInterval     = 5 * time.Second
+	maxHeartbeatInterval     = 5 * time.Minute
+	// clients reconnect in this time after the connection is lost
+	defaultRetry = 3 * time.Second
+)
+
+// StreamSettings of the single event stream
+type StreamSettings struct {
+	// zero means heartbeats are disabled
+	HeartbeatInterval time.Duration
+	// zero means the hint isn't sent
+	Retry time.Duration
+}
+
+// streamSettings returns settings of the event stream of the request: settings of the longest matching route prefix
+// override the defaults, heartbeat interval requested by client with "heartbeat" query parameter (in seconds)
+// overrides the configured one within configured bounds
+func (c StreamConfig) streamSettings(r *http.Request) (StreamSettings, error) {
+	settings := StreamSettings{
+		HeartbeatInterval: time.Duration(c.HeartbeatInterval),
+		Retry:             time.Duration(c.Retry),
+	}
+
+	matched := ""
+	for prefix := range c.Routes {
+		if len(prefix) > len(matched) && matchRoutePrefix(r.URL.Path, prefix) {
+			matched = prefix
+		}
+	}
+	if route, ok := c.Routes[matched]; ok {
+		if route.HeartbeatInterval != nil {
+			settings.HeartbeatInterval = time.Duration(*route.HeartbeatInterval)
+		}
+		if route.Retry != nil {
+			settings.Retry = time.Duration(*route.Retry)
+		}
+	}
+
+	if s := r.URL.Query().Get("heartbeat"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return settings, fmt.Errorf("invalid heartbeat interval: %s", s)
+		}
+		interval := time.Duration(seconds) * time.Second
+		if interval < time.Duration(c.MinHeartbeatInterval) {
+			interval = time.Duration(c.MinHeartbeatInterval)
+		}
+		if interval > time.Duration(c.MaxHeartbeatInterval) {
+			interval = time.Duration(c.MaxHeartbeatInterval)
+		}
+		settings.HeartbeatInterval = interval
+	}
+	return settings, nil
+}
+
+// matchRoutePrefix reports whether path is the prefix or is under it, e.g. "/sub/news" matches "/sub"
+func matchRoutePrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// heartbeats returns channel which receives ticks with the heartbeat interval and func to stop it,
+// nil channel never receives, so heartbeats are disabled with zero interval
+func heartbeats(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// writeHeartbeat writes comment line, it's ignored by clients but keeps connection active
+func writeHeartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, ":heartbeat\n\n")
+	return err
+}
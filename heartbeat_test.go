@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSettings(t *testing.T) {
+	d := func(v time.Duration) *Duration {
+		return (*Duration)(&v)
+	}
+	c := StreamConfig{
+		HeartbeatInterval:    Duration(30 * time.Second),
+		MinHeartbeatInterval: Duration(5 * time.Second),
+		MaxHeartbeatInterval: Duration(5 * time.Minute),
+		Retry:                Duration(3 * time.Second),
+		Routes: map[string]RouteStreamConfig{
+			"/sub":             {HeartbeatInterval: d(time.Minute)},
+			"/sub/news":        {Retry: d(10 * time.Second)},
+			"/multisub-split/": {HeartbeatInterval: d(0), Retry: d(0)},
+		},
+	}
+
+	tests := []struct {
+		url       string
+		heartbeat time.Duration
+		retry     time.Duration
+		wantErr   bool
+	}{
+		{"/listen/single/ch", 30 * time.Second, 3 * time.Second, false},
+		{"/sub/ch", time.Minute, 3 * time.Second, false},
+		// the longest prefix wins, missed settings are inherited from the defaults
+		{"/sub/news", 30 * time.Second, 10 * time.Second, false},
+		{"/sub/news/", 30 * time.Second, 10 * time.Second, false},
+		// prefix matches whole path segments only
+		{"/sub/newsletter", time.Minute, 3 * time.Second, false},
+		{"/subscribe/ch", 30 * time.Second, 3 * time.Second, false},
+		{"/multisub-split/a,b", 0, 0, false},
+		// client asks for heartbeat interval within configured bounds
+		{"/sub/ch?heartbeat=15", 15 * time.Second, 3 * time.Second, false},
+		{"/sub/ch?heartbeat=1", 5 * time.Second, 3 * time.Second, false},
+		{"/sub/ch?heartbeat=3600", 5 * time.Minute, 3 * time.Second, false},
+		{"/multisub-split/a?heartbeat=10", 10 * time.Second, 0, false},
+		{"/sub/ch?heartbeat=0", 0, 0, true},
+		{"/sub/ch?heartbeat=-5", 0, 0, true},
+		{"/sub/ch?heartbeat=5s", 0, 0, true},
+	}
+	for _, tt := range tests {
+		settings, err := c.streamSettings(httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.url, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if settings.HeartbeatInterval != tt.heartbeat || settings.Retry != tt.retry {
+			t.Errorf("%s: got %+v, want heartbeat %s, retry %s", tt.url, settings, tt.heartbeat, tt.retry)
+		}
+	}
+}
+
+func TestStreamHeartbeats(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	h.stream = StreamConfig{
+		HeartbeatInterval:    Duration(10 * time.Millisecond),
+		MinHeartbeatInterval: Duration(time.Millisecond),
+		MaxHeartbeatInterval: Duration(20 * time.Millisecond),
+		Retry:                Duration(1500 * time.Millisecond),
+		Routes: map[string]RouteStreamConfig{
+			"/listen/multi": {HeartbeatInterval: new(Duration)},
+		},
+	}
+	router := h.Router()
+
+	tests := []struct {
+		url           string
+		wantHeartbeat bool
+	}{
+		{"/listen/single/ch", true},
+		// heartbeats are disabled for the route
+		{"/listen/multi/ch", false},
+		// client asks for heartbeats, the interval is limited by the maximum
+		{"/listen/multi/ch?heartbeat=1", true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil).WithContext(ctx))
+		cancel()
+		body := w.Body.String()
+		if !strings.Contains(body, "retry:1500\n") {
+			t.Errorf("%s: retry hint isn't sent: %q", tt.url, body)
+		}
+		if got := strings.Contains(body, ":heartbeat\n\n"); got != tt.wantHeartbeat {
+			t.Errorf("%s: heartbeat sent %v, want %v: %q", tt.url, got, tt.wantHeartbeat, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/listen/single/ch?heartbeat=often", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid heartbeat interval: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
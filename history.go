@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// HistoryResponse struct, page of events of a channel
+type HistoryResponse struct {
+	Events []JSONEvent `json:"events"`
+	// id of the last event in the page, it's passed as "before" cursor to get the next page
+	// of newest first history, or as "after" cursor for oldest first history
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// channelHistory responds with page of stored events of the channel.
+// Events are selected by exclusive "before" and "after" cursors (event ids),
+// ordered newest first by default or oldest first with "order=asc", up to "limit" events.
+func (h *Handler) channelHistory(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
+	channelID := chi.URLParam(r, "channel")
+	if channelID == "" {
+		log.Debugf("missed channel id")
+		http.Error(w, "Missed channel id!", http.StatusBadRequest)
+		return
+	}
+	log = log.With(Fields{"channel": channelID})
+
+	query, err := getPageQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, hasMore, err := h.sse.History(channelID, query)
+	if err != nil {
+		log.Errorf("get history: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	resp := HistoryResponse{
+		Events:  make([]JSONEvent, 0, len(events)),
+		HasMore: hasMore,
+	}
+	for _, event := range events {
+		resp.Events = append(resp.Events, mapSseEventToJSON(event.MapToSseEvent()))
+	}
+	if hasMore {
+		resp.NextCursor = resp.Events[len(resp.Events)-1].ID
+	}
+	log.With(Fields{"event": "history_requested"}).Debugf("channel %s: %d events of history", channelID, len(events))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("encode history response: %v", err)
+	}
+}
+
+// getPageQuery returns page of history requested by client with "before", "after", "limit" and "order" parameters
+func getPageQuery(r *http.Request) (PageQuery, error) {
+	q := r.URL.Query()
+	query := PageQuery{
+		Limit:      defaultHistoryLimit,
+		Descending: true,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return query, errors.New("Wrong limit, expected positive number of events")
+		}
+		if n > maxHistoryLimit {
+			n = maxHistoryLimit
+		}
+		query.Limit = n
+	}
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		query.Descending = false
+	default:
+		return query, errors.New("Wrong order, expected asc or desc")
+	}
+	for param, cursor := range map[string]*int64{"after": &query.AfterID, "before": &query.BeforeID} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		id, err := parseEventID(v)
+		if err != nil || id <= 0 {
+			return query, errors.New("Wrong " + param + " cursor, expected event id")
+		}
+		*cursor = id
+	}
+	return query, nil
+}
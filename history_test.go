@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistoryPagination(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+	var ids []string
+	for _, title := range []string{"1", "2", "3", "4", "5"} {
+		ids = append(ids, formatEventID(publish(t, sse, "ch", title).ID))
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		want     []string
+		wantMore bool
+	}{
+		{"newest first", "?limit=2", []string{ids[4], ids[3]}, true},
+		{"next page", "?limit=2&before=" + ids[3], []string{ids[2], ids[1]}, true},
+		{"the last page", "?limit=2&before=" + ids[1], []string{ids[0]}, false},
+		{"oldest first", "?order=asc&limit=3", []string{ids[0], ids[1], ids[2]}, true},
+		{"oldest first after cursor", "?order=asc&after=" + ids[2], []string{ids[3], ids[4]}, false},
+		{"between cursors", "?after=" + ids[0] + "&before=" + ids[3], []string{ids[2], ids[1]}, false},
+	}
+	for _, tt := range tests {
+		resp := HistoryResponse{}
+		if w := getJSON(t, router, http.MethodGet, "/history/ch"+tt.query, &resp); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, %s", tt.name, w.Code, w.Body.String())
+		}
+		var got []string
+		for _, e := range resp.Events {
+			got = append(got, e.ID)
+		}
+		if len(got) != len(tt.want) || resp.HasMore != tt.wantMore {
+			t.Errorf("%s: got %v, has more %v, want %v, %v", tt.name, got, resp.HasMore, tt.want, tt.wantMore)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		if tt.wantMore && resp.NextCursor != got[len(got)-1] {
+			t.Errorf("%s: next cursor %s, want %s", tt.name, resp.NextCursor, got[len(got)-1])
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=x", "?order=up", "?before=x", "?after=-1"} {
+		if w := getJSON(t, router, http.MethodGet, "/history/ch"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// unreadableStorage fails to read events of channels
+type unreadableStorage struct {
+	*MemStorage
+}
+
+func (s unreadableStorage) GetPage(channelID string, query PageQuery) ([]Event, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (s unreadableStorage) GetLast(channelID string, n int) ([]Event, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (s unreadableStorage) GetSince(channelID string, since time.Time) ([]Event, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHistoryStorageFailure(t *testing.T) {
+	h, sse := newTestHandler(t, unreadableStorage{NewMemStorage()})
+	router := h.Router()
+	publish(t, sse, "ch", "1")
+
+	// failure is not mistaken for empty history
+	for _, url := range []string{"/history/ch", "/poll/ch?last=1", "/poll/ch?since=0"} {
+		if w := getJSON(t, router, http.MethodGet, url, nil); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d, want %d", url, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
@@ -1,92 +1,310 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-contrib/sse"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/jwtauth"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	uuid "github.com/satori/go.uuid"
 )
 
 type (
 	// Handler structure
 	Handler struct {
-		log Logger
-		sse *SSE
+		log    Logger
+		sse    *SSE
+		inbox  *Inbox
+		stream StreamConfig
+		// current *Auth, it's replaced when configuration is reloaded
+		auth atomic.Value
+		// reloads configuration, nil if reload isn't supported
+		reload func() error
+		// allowed origins of websocket connections, same origin only if nil
+		cors *CORS
 	}
 
 	// EventDataRequest struct
 	EventDataRequest struct {
+		Event   string      `json:"event"`
 		Title   string      `json:"title"`
 		Payload interface{} `json:"payload"`
 		TTL     int64       `json:"ttl"`
 	}
+
+	// PublishResponse struct, describes the published event
+	PublishResponse struct {
+		ID        string `json:"id"`
+		Channel   string `json:"channel"`
+		Event     string `json:"event"`
+		Timestamp string `json:"timestamp"`
+		// number of seconds the event is available for delivery
+		TTL int64 `json:"ttl"`
+	}
+
+	// ErrorResponse struct, error of the request for clients which ask for json
+	ErrorResponse struct {
+		Error string `json:"error"`
+	}
+
+	// BatchItemRequest struct, one event to be published to several channels
+	BatchItemRequest struct {
+		Channels []string `json:"channels"`
+		EventDataRequest
+	}
+
+	// BatchItemResult struct, result of publishing of the batch item
+	BatchItemResult struct {
+		Error   string          `json:"error,omitempty"`
+		Results []PublishResult `json:"results"`
+	}
+
+	// PublishResult struct, result of publishing of event to a channel
+	PublishResult struct {
+		Channel string `json:"channel"`
+		ID      string `json:"id,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	authContextKey struct{}
+
+	// APIKeyInfo struct, describes api key without its secret
+	APIKeyInfo struct {
+		Name       string     `json:"name"`
+		Channels   []string   `json:"channels"`
+		Operations []string   `json:"operations"`
+		NotBefore  *time.Time `json:"not_before,omitempty"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+		Active     bool       `json:"active"`
+	}
+)
+
+const (
+	// maximum number of items in batch publish request
+	maxBatchItems = 1000
+	// maximum number of channels in all items of batch publish request
+	maxBatchChannels = 1000
+	// maximum size of batch publish request body
+	maxBatchBodySize = 10 << 20
+	// clients reconnect in this time or up to twice as long when server is shutting down
+	minShutdownRetry = 2 * time.Second
+	// maximum number of the most recent events client can ask to replay
+	maxReplayEvents = 1000
+)
+
+// reasons of the reconnect event
+const (
+	reconnectSlowConsumer = "slow_consumer"
+	reconnectShutdown     = "shutdown"
 )
 
 // NewHandler is a factory function, returns a new instance of the Handler structure
-func NewHandler(log Logger, sse *SSE) *Handler {
-	return &Handler{
-		log: log,
-		sse: sse,
+func NewHandler(log Logger, sse *SSE, auth *Auth, stream StreamConfig) *Handler {
+	h := &Handler{
+		log:    log,
+		sse:    sse,
+		inbox:  NewInbox(sse.storage, sse.relay),
+		stream: stream,
 	}
+	h.SetAuth(auth)
+	return h
+}
+
+// Auth returns the current authentication settings
+func (h *Handler) Auth() *Auth {
+	return h.auth.Load().(*Auth)
+}
+
+// SetAuth replaces authentication settings, requests which are already authenticated are not affected
+func (h *Handler) SetAuth(auth *Auth) {
+	h.auth.Store(auth)
+}
+
+// SetCORS sets cors settings which allow origins of websocket connections
+func (h *Handler) SetCORS(cors *CORS) {
+	h.cors = cors
+}
+
+// OnReload sets func which reloads configuration by request of admin
+func (h *Handler) OnReload(reload func() error) {
+	h.reload = reload
 }
 
 // Router returns instance of the chi.Router
 func (h *Handler) Router() chi.Router {
 	r := chi.NewRouter()
+	r.Use(h.snapshotAuth)
 
 	r.Get("/", h.healthCheck)
 	r.Get("/health", h.healthCheck)
+	r.Handle("/metrics", promhttp.Handler())
 
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	r.Route("/listen", func(r chi.Router) {
-		if os.Getenv("BASIC_AUTH_USER") != "" && os.Getenv("BASIC_AUTH_PASSWORD") != "" {
-			r.Use(basicAuth(os.Getenv("BASIC_AUTH_USER"), os.Getenv("BASIC_AUTH_PASSWORD")))
-		}
+		r.Use(h.withAuth(func(a *Auth) func(http.Handler) http.Handler {
+			if a.BasicAuthUser == "" || a.BasicAuthPassword == "" {
+				return passThrough
+			}
+			return basicAuth(a.BasicAuthUser, a.BasicAuthPassword)
+		}))
 		r.HandleFunc("/", h.listener)
 		r.HandleFunc("/dump", h.dump)
-		r.HandleFunc("/single/{channel}", h.subscribeToSingleChannel)
-		r.HandleFunc("/multi/{channels}", h.subscribeToMultiChannels)
+		// subscriptions of the listener page are authorized like the ones of other endpoints
+		r.Group(func(r chi.Router) {
+			h.requireJWT(r)
+			r.With(h.authorizeChannels("channel")).HandleFunc("/single/{channel}", h.subscribeToSingleChannel)
+			r.With(h.authorizeChannels("channels")).HandleFunc("/multi/{channels}", h.subscribeToMultiChannels)
+		})
 	})
 
 	r.Route("/sub", func(r chi.Router) {
-		if os.Getenv("JWT_SECRET") != "" {
-			r.Use(jwtauth.Verify(jwtauth.New("HS256", []byte(os.Getenv("JWT_SECRET")), nil), tokenFromQuery))
-			r.Use(jwtauth.Authenticator)
-		}
-
-		r.Get("/{channel}", h.subscribeToSingleChannel)
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channel")).Get("/{channel}", h.subscribeToSingleChannel)
 	})
 
 	r.Route("/multisub-split", func(r chi.Router) {
-		if os.Getenv("JWT_SECRET") != "" {
-			r.Use(jwtauth.Verify(jwtauth.New("HS256", []byte(os.Getenv("JWT_SECRET")), nil), tokenFromQuery))
-			r.Use(jwtauth.Authenticator)
-		}
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channels")).Get("/{channels}", h.subscribeToMultiChannels)
+	})
+
+	r.Route("/ws", func(r chi.Router) {
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channel")).Get("/{channel}", h.websocketSingleChannel)
+	})
+
+	r.Route("/ws-multi", func(r chi.Router) {
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channels")).Get("/{channels}", h.websocketMultiChannels)
+	})
+
+	r.Route("/poll", func(r chi.Router) {
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channels")).Get("/{channels}", h.pollChannels)
+	})
 
-		r.Get("/{channels}", h.subscribeToMultiChannels)
+	r.Route("/history", func(r chi.Router) {
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channel")).Get("/{channel}", h.channelHistory)
+	})
+
+	r.Route("/inbox/{channel}", func(r chi.Router) {
+		h.requireJWT(r)
+		r.Use(h.authorizeChannels("channel"))
+		r.Get("/", h.inboxItems)
+		r.Get("/unread", h.unreadCount)
+		r.Post("/state", h.setInboxState)
+	})
+
+	r.Route("/ack", func(r chi.Router) {
+		h.requireJWT(r)
+		r.With(h.authorizeChannels("channels")).Post("/{channels}", h.ackEvents)
 	})
 
 	r.Route("/pub", func(r chi.Router) {
-		if os.Getenv("BASIC_TOKEN") != "" {
-			r.Use(basicToken(os.Getenv("BASIC_TOKEN")))
-		}
+		r.Use(h.withAuth(func(a *Auth) func(http.Handler) http.Handler {
+			return a.Signatures.Verify
+		}))
+		// channels of batch items are checked by the handler
+		r.With(h.requireAPIKey(OpPublish, "")).Post("/", h.publishBatch)
+		r.With(h.requireAPIKey(OpPublish, "channel")).Post("/{channel}", h.publishToChannel)
+	})
 
-		r.Post("/{channel}", h.publishToChannel)
+	// dump and admin endpoints are available only with api keys
+	r.With(h.requireKeyStore, h.requireAPIKey(OpDump, "channel")).Get("/dump/{channel}", h.dumpChannel)
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(h.requireKeyStore, h.requireAPIKey(OpAdmin, ""))
+		r.Get("/keys", h.listKeys)
+		r.Post("/keys/reload", h.reloadKeys)
+		r.Post("/reload", h.reloadConfig)
 	})
 
 	return r
 }
 
+// snapshotAuth keeps the current authentication settings in the request context,
+// so all middlewares of the request use the same settings even if they are replaced meanwhile
+func (h *Handler) snapshotAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, h.Auth())))
+	})
+}
+
+// requestAuth returns authentication settings the request is handled with
+func (h *Handler) requestAuth(r *http.Request) *Auth {
+	if a, ok := r.Context().Value(authContextKey{}).(*Auth); ok {
+		return a
+	}
+	return h.Auth()
+}
+
+// withAuth returns middleware which is built from authentication settings of the request,
+// so settings can be replaced without rebuilding the router
+func (h *Handler) withAuth(build func(a *Auth) func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			build(h.requestAuth(r))(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorizeChannels checks channels from the url parameter against jwt claims, see authorizeChannels
+func (h *Handler) authorizeChannels(param string) func(http.Handler) http.Handler {
+	return h.withAuth(func(a *Auth) func(http.Handler) http.Handler {
+		return authorizeChannels(a.JWT, param)
+	})
+}
+
+// requireAPIKey checks api key of publisher, see requireAPIKey
+func (h *Handler) requireAPIKey(op, param string) func(http.Handler) http.Handler {
+	return h.withAuth(func(a *Auth) func(http.Handler) http.Handler {
+		return requireAPIKey(a.Keys, op, param)
+	})
+}
+
+// requireKeyStore hides routes which are available only if api keys are configured
+func (h *Handler) requireKeyStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.requestAuth(r).Keys == nil {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestLog returns logger which adds id of the request to messages
+func (h *Handler) requestLog(r *http.Request) Logger {
+	return h.log.With(Fields{"request_id": middleware.GetReqID(r.Context())})
+}
+
+// requireJWT protects routes with jwt passed in the query string, if jwt authentication is enabled
+func (h *Handler) requireJWT(r chi.Router) {
+	r.Use(h.withAuth(func(a *Auth) func(http.Handler) http.Handler {
+		if a.JWT == nil {
+			return passThrough
+		}
+		verify := a.JWT.Verify(tokenFromQuery)
+		return func(next http.Handler) http.Handler {
+			return verify(jwtauth.Authenticator(next))
+		}
+	}))
+}
+
 func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain")
@@ -110,11 +328,71 @@ func (h *Handler) dump(w http.ResponseWriter, r *http.Request) {
 		"dump":    dump,
 	})
 	if err != nil {
-		h.log.Errorf("parse template: %v", err)
+		h.requestLog(r).Errorf("parse template: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
+// dumpChannel responds with all stored events of the channel as json
+func (h *Handler) dumpChannel(w http.ResponseWriter, r *http.Request) {
+	events := h.sse.DumpStorage(chi.URLParam(r, "channel"))
+	result := make([]JSONEvent, 0, len(events))
+	for _, event := range events {
+		result = append(result, mapSseEventToJSON(event.MapToSseEvent()))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.requestLog(r).Errorf("encode dump response: %v", err)
+	}
+}
+
+// listKeys responds with api keys in the store, secrets aren't disclosed
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	keys := h.requestAuth(r).Keys.Keys()
+	result := make([]APIKeyInfo, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, APIKeyInfo{
+			Name:       k.Name,
+			Channels:   k.Channels,
+			Operations: k.Operations,
+			NotBefore:  k.NotBefore,
+			ExpiresAt:  k.ExpiresAt,
+			Active:     k.activeAt(now),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.requestLog(r).Errorf("encode keys response: %v", err)
+	}
+}
+
+// reloadKeys re-reads the api keys file, the current keys stay in use if the file is invalid
+func (h *Handler) reloadKeys(w http.ResponseWriter, r *http.Request) {
+	if err := h.requestAuth(r).Keys.Reload(); err != nil {
+		h.requestLog(r).Errorf("reload api keys: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	h.requestLog(r).With(Fields{"event": "api_keys_reloaded", "api_key": apiKeyFromContext(r.Context()).Name}).Infof("%d api keys loaded", h.requestAuth(r).Keys.Len())
+	w.Write([]byte("api keys have been reloaded"))
+}
+
+// reloadConfig reloads authentication and cors settings, streams which are already open stay connected
+func (h *Handler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if h.reload == nil {
+		http.Error(w, "Reload is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err := h.reload(); err != nil {
+		h.requestLog(r).Errorf("reload configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	h.requestLog(r).With(Fields{"event": "config_reloaded", "api_key": apiKeyFromContext(r.Context()).Name}).Infof("configuration has been reloaded")
+	w.Write([]byte("configuration has been reloaded"))
+}
+
 func (h *Handler) listener(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	channelID := r.FormValue("channel")
@@ -141,7 +419,7 @@ func (h *Handler) listener(w http.ResponseWriter, r *http.Request) {
 		"endpoint":      endpoint,
 	})
 	if err != nil {
-		h.log.Errorf("parse template: %v", err)
+		h.requestLog(r).Errorf("parse template: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
@@ -149,92 +427,251 @@ func (h *Handler) listener(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) publishToChannel(w http.ResponseWriter, r *http.Request) {
 	channelID := chi.URLParam(r, "channel")
 	if channelID == "" {
-		http.Error(w, "Missed channel id!", http.StatusBadRequest)
+		publishError(w, r, "Missed channel id!", http.StatusBadRequest)
 		return
 	}
+	log := h.requestLog(r).With(Fields{"channel": channelID})
 	payload := EventDataRequest{}
 	if err := decodeJSON(r.Body, &payload); err != nil {
-		h.log.Errorf("decode json: %v", err)
-		http.Error(w, "Malformed JSON", http.StatusBadRequest)
+		log.Errorf("decode json: %v", err)
+		publishError(w, r, "Malformed JSON", http.StatusBadRequest)
 		return
 	}
+	if payload.Event != "" {
+		if err := ValidateEventType(payload.Event); err != nil {
+			publishError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	eventData := EventData{
 		Title:   payload.Title,
 		Payload: payload.Payload,
 	}
-	if err := h.sse.PubEvent(channelID, eventData, payload.TTL); err != nil {
-		h.log.Errorf("publish to channel %s: %v", channelID, err)
-		http.Error(w, fmt.Sprintf("could not publish to channel %s", channelID), http.StatusBadRequest)
+	event, err := h.sse.PubEvent(channelID, payload.Event, eventData, payload.TTL)
+	if err != nil {
+		log.Errorf("publish to channel %s: %v", channelID, err)
+		publishError(w, r, fmt.Sprintf("could not publish to channel %s", channelID), http.StatusBadRequest)
 		return
 	}
 
-	h.log.Debugf("[sent_event] publish to channel %s with payload: %+v", channelID, payload)
+	if log.Enabled(DebugLevel) {
+		log.With(Fields{"event": "sent_event", "event_id": formatEventID(event.ID)}).Debugf("publish to channel %s with payload: %+v", channelID, payload)
+	}
+
+	// legacy clients which don't ask for json get plain text response
+	if !acceptsJSON(r) {
+		w.Write([]byte("event has been sent"))
+		return
+	}
 
-	w.Write([]byte("event has been sent"))
+	se := event.MapToSseEvent()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(PublishResponse{
+		ID:        se.Id,
+		Channel:   strings.ToLower(channelID),
+		Event:     se.Event,
+		Timestamp: time.Unix(0, event.Timestamp).UTC().Format(time.RFC3339Nano),
+		TTL:       h.sse.EffectiveTTL(event),
+	}); err != nil {
+		log.Errorf("encode publish response: %v", err)
+	}
+}
+
+// publishBatch publishes every item of the batch to all its channels,
+// responds with per-item results in the same order as items in the request
+func (h *Handler) publishBatch(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
+	items := []BatchItemRequest{}
+	if err := decodeJSON(http.MaxBytesReader(w, r.Body, maxBatchBodySize), &items); err != nil {
+		log.Errorf("decode json: %v", err)
+		http.Error(w, "Malformed JSON", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchItems {
+		http.Error(w, fmt.Sprintf("Too many items in batch, maximum is %d", maxBatchItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+	channels := 0
+	for _, item := range items {
+		channels += len(item.Channels)
+	}
+	if channels > maxBatchChannels {
+		http.Error(w, fmt.Sprintf("Too many channels in batch, maximum is %d", maxBatchChannels), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key := apiKeyFromContext(r.Context())
+	results := make([]BatchItemResult, len(items))
+	for i, item := range items {
+		results[i] = h.publishBatchItem(log, item, key)
+	}
+
+	log.With(Fields{"event": "sent_batch"}).Debugf("published batch of %d items", len(items))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Errorf("encode batch response: %v", err)
+	}
+}
+
+// publishBatchItem publishes the item to channels granted by api key,
+// nil key means publishers authentication is disabled
+func (h *Handler) publishBatchItem(log Logger, item BatchItemRequest, key *APIKey) BatchItemResult {
+	result := BatchItemResult{Results: make([]PublishResult, 0, len(item.Channels))}
+	if len(item.Channels) == 0 {
+		result.Error = "missed channels"
+		return result
+	}
+	if item.Event != "" {
+		if err := ValidateEventType(item.Event); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	eventData := EventData{
+		Title:   item.Title,
+		Payload: item.Payload,
+	}
+	for _, channelID := range item.Channels {
+		res := PublishResult{Channel: channelID}
+		if channelID == "" {
+			res.Error = "missed channel id"
+			result.Results = append(result.Results, res)
+			continue
+		}
+		if key != nil && !key.Allows(OpPublish, channelID) {
+			res.Error = "forbidden"
+			result.Results = append(result.Results, res)
+			continue
+		}
+		event, err := h.sse.PubEvent(channelID, item.Event, eventData, item.TTL)
+		if err != nil {
+			log.With(Fields{"channel": channelID}).Errorf("publish to channel %s: %v", channelID, err)
+			res.Error = fmt.Sprintf("could not publish to channel %s", channelID)
+		} else {
+			res.ID = formatEventID(event.ID)
+		}
+		result.Results = append(result.Results, res)
+	}
+	return result
 }
 
 func (h *Handler) subscribeToSingleChannel(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
 	channelID := chi.URLParam(r, "channel")
 	if channelID == "" {
-		h.log.Debugf("missed channel id")
+		log.Debugf("missed channel id")
 		http.Error(w, "Missed channel id!", http.StatusBadRequest)
 		return
 	}
+	log = log.With(Fields{"channel": channelID})
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		h.log.Warnf("streaming unsupported: channel %s", channelID)
+		log.Warnf("streaming unsupported: channel %s", channelID)
 		http.Error(w, "Streaming unsupported!", http.StatusNotImplemented)
 		return
 	}
 
-	listener, history, err := h.sse.SubscribeToChannel(channelID, getLastEventID(r))
+	settings, err := h.stream.streamSettings(r)
+	if err != nil {
+		log.Debugf("%v", err)
+		http.Error(w, "Invalid heartbeat interval!", http.StatusBadRequest)
+		return
+	}
+	replay, err := getReplay(r)
+	if err != nil {
+		log.Debugf("wrong history replay: %v", err)
+		http.Error(w, fmt.Sprintf("Wrong history replay: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	listener, history, err := h.sse.SubscribeToChannel(channelID, replay)
 	if err != nil {
-		h.log.Errorf("subscribe to channel %s with last event id %s", channelID, getLastEventID(r))
+		log.Errorf("subscribe to channel %s with last event id %s: %v", channelID, getLastEventID(r), err)
 		http.Error(w, "Could not subscribe to events channel", http.StatusInternalServerError)
 		return
 	}
 	defer h.sse.Unsubscribe(channelID, listener)
+	defer trackConnection(r)()
 
 	// Set the headers related to event streaming.
-	if err := openHTTPConnection(w, r); err != nil {
-		h.log.Errorf("open http connection: %s", err.Error())
+	if err := openHTTPConnection(w, r, settings.Retry); err != nil {
+		log.Errorf("open http connection: %s", err.Error())
 		return
 	}
 	flusher.Flush()
 
-	h.log.Debugf("[client_connected] client connected: %s", channelID)
+	log.With(Fields{"event": "client_connected"}).Debugf("client connected: %s", channelID)
+
+	lastEventID := getLastEventID(r)
 
 	// send historical events
 	for _, event := range history {
 		if !event.IsExpired() {
-			err := sse.Encode(w, event.MapToSseEvent())
+			se := event.MapToSseEvent()
+			err := sse.Encode(w, se)
 			if err != nil {
-				h.log.Errorf("sse encoding: %s (channel id: %s, event: %#v)", err.Error(), channelID, event)
+				log.With(Fields{"event_id": se.Id}).Errorf("sse encoding: %s (channel id: %s, event: %#v)", err.Error(), channelID, event)
 				return
 			}
 			flusher.Flush()
-			h.log.Debugf("[channel_received_events_history] channel %s: received event: %+v", channelID, event)
+			lastEventID = se.Id
+			if log.Enabled(DebugLevel) {
+				log.With(Fields{"event": "channel_received_events_history", "event_id": se.Id}).Debugf("channel %s: received event: %+v", channelID, event)
+			}
 		}
 	}
 
+	heartbeat, stopHeartbeats := heartbeats(settings.HeartbeatInterval)
+	defer stopHeartbeats()
+
 	for {
 		select {
 		case <-r.Context().Done():
-			h.log.Debugf("[client_disconnected] client closed connection: %s", channelID)
+			log.With(Fields{"event": "client_disconnected", "dropped": listener.Dropped()}).Debugf("client closed connection: %s", channelID)
+			return
+		case <-listener.Evicted():
+			log.With(Fields{"event": "client_evicted", "dropped": listener.Dropped()}).Warnf("slow client disconnected: %s", channelID)
+			if err := sse.Encode(w, reconnectEvent(reconnectSlowConsumer, lastEventID, 0)); err == nil {
+				flusher.Flush()
+			}
 			return
-		case event := <-listener:
+		case <-h.sse.Done():
+			log.With(Fields{"event": "client_shutdown"}).Debugf("server is shutting down, disconnect client: %s", channelID)
+			if err := sse.Encode(w, reconnectEvent(reconnectShutdown, lastEventID, shutdownRetry())); err == nil {
+				flusher.Flush()
+			}
+			return
+		case <-heartbeat:
+			if err := writeHeartbeat(w); err != nil {
+				log.With(Fields{"event": "client_disconnected"}).Debugf("write heartbeat: %s (channel id: %s)", err.Error(), channelID)
+				return
+			}
+			flusher.Flush()
+		case event := <-listener.Events():
 			if e, ok := event.(Event); ok {
-				err := sse.Encode(w, e.MapToSseEvent())
+				se := e.MapToSseEvent()
+				err := sse.Encode(w, se)
 				if err != nil {
-					h.log.Errorf("sse encoding: %s (channel id: %s, event: %#v)", err.Error(), channelID, event)
+					log.With(Fields{"event_id": se.Id}).Errorf("sse encoding: %s (channel id: %s, event: %#v)", err.Error(), channelID, event)
 					return
 				}
 				flusher.Flush()
-				h.log.Debugf("[channel_received_event] channel %s: received event: %+v", channelID, event)
+				if se.Id != "" {
+					lastEventID = se.Id
+				}
+				if log.Enabled(DebugLevel) {
+					log.With(Fields{"event": "channel_received_event", "event_id": se.Id}).Debugf("channel %s: received event: %+v", channelID, event)
+				}
 			} else {
-				h.log.Errorf("event is not Event type: %#v", event)
+				log.Errorf("event is not Event type: %#v", event)
 			}
 		}
 	}
@@ -242,67 +679,116 @@ func (h *Handler) subscribeToSingleChannel(w http.ResponseWriter, r *http.Reques
 
 //multisub-split
 func (h *Handler) subscribeToMultiChannels(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
 	channelsStr := chi.URLParam(r, "channels")
 	if channelsStr == "" {
-		h.log.Debugf("missed channel id")
+		log.Debugf("missed channel id")
 		http.Error(w, "Missed channel id!", http.StatusBadRequest)
 		return
 	}
 	channels := strings.Split(channelsStr, ",")
+	log = log.With(Fields{"channel": channelsStr})
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		h.log.Warnf("streaming unsupported: channels: %s", channelsStr)
+		log.Warnf("streaming unsupported: channels: %s", channelsStr)
 		http.Error(w, "Streaming unsupported!", http.StatusNotImplemented)
 		return
 	}
 
-	listener, history, err := h.sse.SubscribeToMultiChannel(channels, getLastEventID(r))
+	settings, err := h.stream.streamSettings(r)
+	if err != nil {
+		log.Debugf("%v", err)
+		http.Error(w, "Invalid heartbeat interval!", http.StatusBadRequest)
+		return
+	}
+	replay, err := getReplay(r)
+	if err != nil {
+		log.Debugf("wrong history replay: %v", err)
+		http.Error(w, fmt.Sprintf("Wrong history replay: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	listener, history, err := h.sse.SubscribeToMultiChannel(channels, replay)
 	if err != nil {
-		h.log.Errorf("subscribe to channels group %s with last event id %s", channelsStr, getLastEventID(r))
+		log.Errorf("subscribe to channels group %s with last event id %s: %v", channelsStr, getLastEventID(r), err)
 		http.Error(w, "Could not subscribe to events channel", http.StatusInternalServerError)
 		return
 	}
 	defer h.sse.UnsubscribeFromMultiChannel(channels, listener)
+	defer trackConnection(r)()
 
 	// Set the headers related to event streaming.
-	if err := openHTTPConnection(w, r); err != nil {
-		h.log.Errorf("open http connection: %s (channels: %s)", err.Error(), channelsStr)
+	if err := openHTTPConnection(w, r, settings.Retry); err != nil {
+		log.Errorf("open http connection: %s (channels: %s)", err.Error(), channelsStr)
 		return
 	}
 	flusher.Flush()
 
-	h.log.Debugf("[client_connected_group] client connected to channels group: %s", channelsStr)
+	log.With(Fields{"event": "client_connected_group"}).Debugf("client connected to channels group: %s", channelsStr)
+
+	lastEventID := getLastEventID(r)
 
 	// send historical events
 	for _, event := range history {
 		if !event.IsExpired() {
-			err := sse.Encode(w, event.MapToSseEvent())
+			se := event.MapToSseEvent()
+			err := sse.Encode(w, se)
 			if err != nil {
-				h.log.Errorf("sse encoding: %s (channels group: %s, event: %#v)", err.Error(), channelsStr, event)
+				log.With(Fields{"event_id": se.Id}).Errorf("sse encoding: %s (channels group: %s, event: %#v)", err.Error(), channelsStr, event)
 				return
 			}
 			flusher.Flush()
-			h.log.Debugf("[group_received_events_history] channels group %s received event: %+v", channelsStr, event)
+			lastEventID = se.Id
+			if log.Enabled(DebugLevel) {
+				log.With(Fields{"event": "group_received_events_history", "event_id": se.Id}).Debugf("channels group %s received event: %+v", channelsStr, event)
+			}
 		}
 	}
 
+	heartbeat, stopHeartbeats := heartbeats(settings.HeartbeatInterval)
+	defer stopHeartbeats()
+
 	for {
 		select {
 		case <-r.Context().Done():
-			h.log.Debugf("[client_disconnected_group] client closed connection to channels group: %s", channelsStr)
+			log.With(Fields{"event": "client_disconnected_group", "dropped": listener.Dropped()}).Debugf("client closed connection to channels group: %s", channelsStr)
 			return
-		case event := <-listener:
+		case <-listener.Evicted():
+			log.With(Fields{"event": "client_evicted_group", "dropped": listener.Dropped()}).Warnf("slow client disconnected from channels group: %s", channelsStr)
+			if err := sse.Encode(w, reconnectEvent(reconnectSlowConsumer, lastEventID, 0)); err == nil {
+				flusher.Flush()
+			}
+			return
+		case <-h.sse.Done():
+			log.With(Fields{"event": "client_shutdown_group"}).Debugf("server is shutting down, disconnect client from channels group: %s", channelsStr)
+			if err := sse.Encode(w, reconnectEvent(reconnectShutdown, lastEventID, shutdownRetry())); err == nil {
+				flusher.Flush()
+			}
+			return
+		case <-heartbeat:
+			if err := writeHeartbeat(w); err != nil {
+				log.With(Fields{"event": "client_disconnected_group"}).Debugf("write heartbeat: %s (channels group: %s)", err.Error(), channelsStr)
+				return
+			}
+			flusher.Flush()
+		case event := <-listener.Events():
 			if e, ok := event.(Event); ok {
-				err := sse.Encode(w, e.MapToSseEvent())
+				se := e.MapToSseEvent()
+				err := sse.Encode(w, se)
 				if err != nil {
-					h.log.Errorf("sse encoding: %s (channels: %s, event: %#v)", err.Error(), channelsStr, event)
+					log.With(Fields{"event_id": se.Id}).Errorf("sse encoding: %s (channels: %s, event: %#v)", err.Error(), channelsStr, event)
 					return
 				}
 				flusher.Flush()
-				h.log.Debugf("[group_received_event] channels group %s received event: %+v", channelsStr, event)
+				if se.Id != "" {
+					lastEventID = se.Id
+				}
+				if log.Enabled(DebugLevel) {
+					log.With(Fields{"event": "group_received_event", "event_id": se.Id}).Debugf("channels group %s received event: %+v", channelsStr, event)
+				}
 			} else {
-				h.log.Errorf("event is not sse.Event type: %#v", event)
+				log.Errorf("event is not sse.Event type: %#v", event)
 			}
 		}
 	}
@@ -324,13 +810,76 @@ func getLastEventID(r *http.Request) string {
 	return lastEventID
 }
 
+// getReplay returns history replay requested by client: last event id,
+// number of the most recent events in the "last" query parameter,
+// time in the "since" parameter, in RFC3339 format or unix timestamp in seconds,
+// and id of at-least-once consumer in the "consumer" parameter
+func getReplay(r *http.Request) (Replay, error) {
+	replay := Replay{LastEventID: getLastEventID(r)}
+	if replay.LastEventID != "" {
+		if _, err := parseEventID(replay.LastEventID); err != nil {
+			return replay, err
+		}
+	}
+	q := r.URL.Query()
+	if v := q.Get("last"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return replay, fmt.Errorf("last: expected positive number of events, got %q", v)
+		}
+		if n > maxReplayEvents {
+			n = maxReplayEvents
+		}
+		replay.Last = n
+	}
+	if v := q.Get("since"); v != "" {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			replay.Since = time.Unix(sec, 0)
+		} else if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			replay.Since = t
+		} else {
+			return replay, fmt.Errorf("since: expected RFC3339 time or unix timestamp, got %q", v)
+		}
+	}
+	if v := q.Get("consumer"); v != "" {
+		if err := ValidateConsumerID(v); err != nil {
+			return replay, err
+		}
+		replay.Consumer = v
+	}
+	return replay, nil
+}
+
+// acceptsJSON reports whether client has asked for json response
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+		if mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// publishError responds with json error to clients which ask for json and with plain text to legacy ones
+func publishError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+}
+
 func decodeJSON(r io.Reader, v interface{}) error {
 	defer io.Copy(ioutil.Discard, r)
 	return json.NewDecoder(r).Decode(v)
 }
 
-// Set the headers related to event streaming.
-func openHTTPConnection(w http.ResponseWriter, r *http.Request) error {
+// Set the headers related to event streaming, non zero retry is sent as the reconnection delay hint.
+func openHTTPConnection(w http.ResponseWriter, r *http.Request, retry time.Duration) error {
 	origin := r.Header.Get("Origin")
 	if origin == "" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -340,12 +889,36 @@ func openHTTPConnection(w http.ResponseWriter, r *http.Request) error {
 	}
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	// connection specific headers are forbidden in http/2
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
 	w.Header().Set("X-Accel-Buffering", "no")
 	w.WriteHeader(http.StatusOK)
 	return sse.Encode(w, sse.Event{
 		Event: "notification",
+		Retry: uint(retry / time.Millisecond),
 		Data:  "SSE connection successfully established",
 	})
 }
+
+// reconnectEvent tells the client it's going to be disconnected, e.g. because it can't keep up with events
+// or the server is shutting down, so it should reconnect and resume from the last received event.
+// Non zero retry is the reconnection delay hint.
+func reconnectEvent(reason, lastEventID string, retry time.Duration) sse.Event {
+	return sse.Event{
+		Event: "reconnect",
+		Retry: uint(retry / time.Millisecond),
+		Data: map[string]string{
+			"reason":        reason,
+			"last_event_id": lastEventID,
+		},
+	}
+}
+
+// shutdownRetry returns reconnection delay for clients of the server which is shutting down,
+// it's randomized so clients don't come back all at once
+func shutdownRetry() time.Duration {
+	return minShutdownRetry + time.Duration(rand.Int63n(int64(minShutdownRetry)))
+}
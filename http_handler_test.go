@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandler returns handler of the server without authentication which keeps events in given storage
+func newTestHandler(t *testing.T, storage Storage) (*Handler, *SSE) {
+	t.Helper()
+	log, err := NewLogger(testWriter{t}, "text", ErrorLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuth(AuthConfig{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(defaultQueueSize, Disconnect)
+	sse := NewSSE(storage, hub, NewLocalRelay(hub), time.Hour)
+	return NewHandler(log, sse, auth, DefaultConfig().Stream), sse
+}
+
+// getJSON requests the url from the handler and decodes json response into v
+func getJSON(t *testing.T, h http.Handler, method, url string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: decode response %q: %v", method, url, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// postJSON posts the body to the url of the handler and decodes json response into v
+func postJSON(t *testing.T, h http.Handler, url, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("POST %s: decode response %q: %v", url, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// publish publishes event with given title to the channel
+func publish(t *testing.T, sse *SSE, channelID, title string) Event {
+	t.Helper()
+	event, err := sse.PubEvent(channelID, "", EventData{Title: title}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// signedRequest returns publish request to the path signed with the secret of the legacy key
+func signedRequest(secret, path string, body []byte, now time.Time) *http.Request {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signedMessage(http.MethodPost, path, ts, body))
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	r.Header.Set(SignatureKeyHeader, legacyKeyName)
+	r.Header.Set(SignatureTimestampHeader, ts)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestPublishEventType(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		want int
+	}{
+		{"custom type", "/pub/ch", `{"event":"order.created","title":"t"}`, http.StatusOK},
+		{"default type", "/pub/ch", `{"title":"t"}`, http.StatusOK},
+		{"invalid type", "/pub/ch", `{"event":"order created","title":"t"}`, http.StatusBadRequest},
+		{"reserved type", "/pub/ch", `{"event":"reconnect","title":"t"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := postJSON(t, router, tt.url, tt.body, nil); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+// batchBody returns batch publish request with items of given numbers of channels
+func batchBody(channels ...int) string {
+	items := make([]BatchItemRequest, len(channels))
+	for i, n := range channels {
+		items[i].Title = "batch"
+		for j := 0; j < n; j++ {
+			items[i].Channels = append(items[i].Channels, fmt.Sprintf("ch_%d_%d", i, j))
+		}
+	}
+	body, _ := json.Marshal(items)
+	return string(body)
+}
+
+func TestPublishBatchLimits(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"single item", batchBody(3), http.StatusOK},
+		{"maximum channels", batchBody(maxBatchChannels/2, maxBatchChannels/2), http.StatusOK},
+		{"too many channels in an item", batchBody(maxBatchChannels + 1), http.StatusRequestEntityTooLarge},
+		{"too many channels in all items", batchBody(maxBatchChannels/2, maxBatchChannels/2, 1), http.StatusRequestEntityTooLarge},
+		{"too many items", batchBody(make([]int, maxBatchItems+1)...), http.StatusRequestEntityTooLarge},
+		{"empty batch", `[]`, http.StatusBadRequest},
+		{"malformed json", `[{"channels":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := postJSON(t, router, "/pub/", tt.body, nil); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+// failingChannelStorage fails to add events to the channel
+type failingChannelStorage struct {
+	*MemStorage
+	channelID string
+}
+
+func (s failingChannelStorage) Add(channelID string, event Event) error {
+	if channelID == s.channelID {
+		return errors.New("disk is full")
+	}
+	return s.MemStorage.Add(channelID, event)
+}
+
+func TestPublishBatchPartialFailure(t *testing.T) {
+	storage := failingChannelStorage{NewMemStorage(), "news_broken"}
+	h, _ := newTestHandler(t, storage)
+	keys := writeFile(t, t.TempDir(), "keys.json", `{"keys":[
+		{"name":"news","key":"news-secret","channels":["news_*"],"operations":["publish"]}
+	]}`)
+	auth, err := NewAuth(AuthConfig{APIKeysFile: keys}, h.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuth(auth)
+
+	r := httptest.NewRequest(http.MethodPost, "/pub/", strings.NewReader(`[
+		{"channels":["news_sport","user_1","","news_broken"],"title":"first"},
+		{"channels":["news_sport"],"event":"reconnect"},
+		{"channels":[]},
+		{"channels":["news_weather"],"title":"last"}
+	]`))
+	r.Header.Set("Authorization", "Bearer news-secret")
+	w := httptest.NewRecorder()
+	h.Router().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var results []BatchItemResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4: %+v", len(results), results)
+	}
+
+	// results of channels are in the order of the request
+	first := results[0].Results
+	if len(first) != 4 {
+		t.Fatalf("got %d results of the first item, want 4: %+v", len(first), first)
+	}
+	if first[0].Channel != "news_sport" || first[0].ID == "" || first[0].Error != "" {
+		t.Errorf("allowed channel: %+v", first[0])
+	}
+	if first[1].Error != "forbidden" || first[1].ID != "" {
+		t.Errorf("channel which isn't granted: %+v", first[1])
+	}
+	if first[2].Error == "" || first[2].ID != "" {
+		t.Errorf("empty channel id: %+v", first[2])
+	}
+	if first[3].Error == "" || first[3].ID != "" {
+		t.Errorf("failed channel: %+v", first[3])
+	}
+	for i, want := range []string{"", "reserved", "missed channels", ""} {
+		if !strings.Contains(results[i].Error, want) || (want == "") != (results[i].Error == "") {
+			t.Errorf("error of item %d = %q, want %q", i, results[i].Error, want)
+		}
+	}
+	// items after failed ones are published
+	if last := results[3].Results; len(last) != 1 || last[0].ID == "" {
+		t.Errorf("last item: %+v", last)
+	}
+	if events := storage.GetAllInChannel("news_sport"); len(events) != 1 || events[0].Data.Title != "first" {
+		t.Errorf("events of news_sport: %+v", events)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/plain", false},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/jsonp", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/pub/ch", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := acceptsJSON(r); got != tt.want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestPublishResponse(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+	publishRequest := func(body, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/pub/Ch", strings.NewReader(body))
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// legacy clients get plain text
+	w := publishRequest(`{"title":"legacy"}`, "")
+	if w.Code != http.StatusOK || w.Body.String() != "event has been sent" {
+		t.Errorf("legacy response: %d %q", w.Code, w.Body.String())
+	}
+
+	w = publishRequest(`{"title":"json","event":"order.created","ttl":60}`, "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("content type %q", ct)
+	}
+	var res PublishResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	events := sse.storage.GetAllInChannel("ch")
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	event := events[1]
+	if res.ID != formatEventID(event.ID) || res.Channel != "ch" || res.Event != "order.created" || res.TTL != 60 {
+		t.Errorf("response %+v, event %+v", res, event)
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, res.Timestamp); err != nil || ts.UnixNano() != event.Timestamp {
+		t.Errorf("timestamp %q, want %d", res.Timestamp, event.Timestamp)
+	}
+
+	// json clients get errors in json
+	w = publishRequest(`{"event":"reconnect"}`, "application/json")
+	var errRes ErrorResponse
+	if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &errRes) != nil || !strings.Contains(errRes.Error, "reserved") {
+		t.Errorf("json error: %d %q", w.Code, w.Body.String())
+	}
+	w = publishRequest(`{`, "application/json")
+	if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &errRes) != nil || errRes.Error != "Malformed JSON" {
+		t.Errorf("json error: %d %q", w.Code, w.Body.String())
+	}
+	w = publishRequest(`{`, "")
+	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "Malformed JSON" {
+		t.Errorf("plain text error: %d %q", w.Code, w.Body.String())
+	}
+}
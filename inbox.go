@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+type (
+	// InboxState is a state of event in the user inbox
+	InboxState string
+
+	// Inbox keeps read state of events in user channels on top of the storage
+	// and notifies subscribers of the channel when the state is changed,
+	// so all clients of the user stay in sync
+	Inbox struct {
+		sync.Mutex
+		storage Storage
+		relay   Relay
+		// state changes of a channel are serialized,
+		// so the unread count sent to subscribers follows the order of changes
+		locks map[string]*inboxLock
+	}
+
+	inboxLock struct {
+		sync.Mutex
+		refs int
+	}
+
+	// InboxItem struct, event with its state
+	InboxItem struct {
+		JSONEvent
+		State InboxState `json:"state"`
+	}
+
+	// InboxResponse struct, page of the user inbox
+	InboxResponse struct {
+		Items []InboxItem `json:"items"`
+		// see HistoryResponse
+		NextCursor string `json:"next_cursor,omitempty"`
+		HasMore    bool   `json:"has_more"`
+		Unread     int    `json:"unread"`
+	}
+
+	// InboxStateRequest struct, sets state of given events or all events in the channel
+	InboxStateRequest struct {
+		IDs   []string   `json:"ids"`
+		All   bool       `json:"all"`
+		State InboxState `json:"state"`
+	}
+
+	// InboxChange struct, payload of the inbox event which is sent to subscribers when state is changed
+	InboxChange struct {
+		IDs    []string   `json:"ids"`
+		State  InboxState `json:"state"`
+		Unread int        `json:"unread"`
+	}
+
+	// UnreadCountResponse struct
+	UnreadCountResponse struct {
+		Unread int `json:"unread"`
+	}
+)
+
+// States of events in the inbox, events are unread until their state is set
+const (
+	InboxUnread    InboxState = "unread"
+	InboxRead      InboxState = "read"
+	InboxDismissed InboxState = "dismissed"
+)
+
+// type of the event which is sent to subscribers when inbox state is changed
+const inboxEventType = "inbox"
+
+// maximum number of events in the state change request
+const maxInboxStateIDs = 1000
+
+// Validate checks the state is known
+func (s InboxState) Validate() error {
+	switch s {
+	case InboxUnread, InboxRead, InboxDismissed:
+		return nil
+	}
+	return fmt.Errorf("unknown inbox state %q, expected %s, %s or %s", s, InboxUnread, InboxRead, InboxDismissed)
+}
+
+// NewInbox is a factory func, returns a new instance of the Inbox structure
+func NewInbox(storage Storage, relay Relay) *Inbox {
+	return &Inbox{storage: storage, relay: relay, locks: make(map[string]*inboxLock)}
+}
+
+// lock locks state of the channel and returns func which unlocks it
+func (i *Inbox) lock(channelID string) func() {
+	i.Lock()
+	l, ok := i.locks[channelID]
+	if !ok {
+		l = &inboxLock{}
+		i.locks[channelID] = l
+	}
+	l.refs++
+	i.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		i.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(i.locks, channelID)
+		}
+		i.Unlock()
+	}
+}
+
+// Items returns events of the history page with their states
+func (i *Inbox) Items(events []Event, channelID string) ([]InboxItem, error) {
+	states, err := i.storage.GetInboxStates(strings.ToLower(channelID))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]InboxItem, 0, len(events))
+	for _, event := range events {
+		state, ok := states[event.ID]
+		if !ok {
+			state = InboxUnread
+		}
+		items = append(items, InboxItem{
+			JSONEvent: mapSseEventToJSON(event.MapToSseEvent()),
+			State:     state,
+		})
+	}
+	return items, nil
+}
+
+// UnreadCount returns number of not expired events in the channel which are unread
+func (i *Inbox) UnreadCount(channelID string) (int, error) {
+	channelID = strings.ToLower(channelID)
+	states, err := i.storage.GetInboxStates(channelID)
+	if err != nil {
+		return 0, err
+	}
+	return unreadCount(i.storage.GetAllInChannel(channelID), states), nil
+}
+
+// SetState sets state of events in the channel, all events if ids are empty,
+// ids of events which aren't in the channel are ignored.
+// Returns events which state has been changed and the number of unread events.
+func (i *Inbox) SetState(channelID string, ids []int64, state InboxState) (InboxChange, error) {
+	change := InboxChange{
+		IDs:   []string{},
+		State: state,
+	}
+	key := strings.ToLower(channelID)
+	defer i.lock(key)()
+	states, err := i.storage.GetInboxStates(key)
+	if err != nil {
+		return change, err
+	}
+	events := i.storage.GetAllInChannel(key)
+
+	requested := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		requested[id] = true
+	}
+	var changed []int64
+	for _, event := range events {
+		if event.IsExpired() || (len(ids) > 0 && !requested[event.ID]) {
+			continue
+		}
+		current, ok := states[event.ID]
+		if !ok {
+			current = InboxUnread
+		}
+		if current != state {
+			changed = append(changed, event.ID)
+		}
+	}
+	if len(changed) == 0 {
+		change.Unread = unreadCount(events, states)
+		return change, nil
+	}
+
+	if err := i.storage.SetInboxState(key, changed, state); err != nil {
+		return change, err
+	}
+	for _, id := range changed {
+		change.IDs = append(change.IDs, formatEventID(id))
+	}
+	// states are read again, they may have been changed by another instance in between
+	if states, err = i.storage.GetInboxStates(key); err != nil {
+		return change, err
+	}
+	change.Unread = unreadCount(events, states)
+
+	// the event isn't stored, it has no id, so it doesn't move last event id of clients
+	err = i.relay.Publish(channelID, Event{
+		Type:      inboxEventType,
+		Data:      EventData{Payload: change},
+		Timestamp: time.Now().UnixNano(),
+	})
+	return change, err
+}
+
+func unreadCount(events []Event, states map[int64]InboxState) int {
+	n := 0
+	for _, event := range events {
+		if _, ok := states[event.ID]; !ok && !event.IsExpired() {
+			n++
+		}
+	}
+	return n
+}
+
+// inboxItems responds with page of events of the channel with their states,
+// it accepts the same parameters as the history endpoint
+func (h *Handler) inboxItems(w http.ResponseWriter, r *http.Request) {
+	channelID := chi.URLParam(r, "channel")
+	log := h.requestLog(r).With(Fields{"channel": channelID})
+
+	query, err := getPageQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, hasMore, err := h.sse.History(channelID, query)
+	if err != nil {
+		log.Errorf("get history: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	items, err := h.inbox.Items(events, channelID)
+	if err != nil {
+		log.Errorf("get inbox states: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	unread, err := h.inbox.UnreadCount(channelID)
+	if err != nil {
+		log.Errorf("count unread events: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	resp := InboxResponse{
+		Items:   items,
+		HasMore: hasMore,
+		Unread:  unread,
+	}
+	if hasMore {
+		resp.NextCursor = items[len(items)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("encode inbox response: %v", err)
+	}
+}
+
+// unreadCount responds with number of unread events in the channel
+func (h *Handler) unreadCount(w http.ResponseWriter, r *http.Request) {
+	channelID := chi.URLParam(r, "channel")
+	log := h.requestLog(r).With(Fields{"channel": channelID})
+
+	unread, err := h.inbox.UnreadCount(channelID)
+	if err != nil {
+		log.Errorf("count unread events: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(UnreadCountResponse{Unread: unread}); err != nil {
+		log.Errorf("encode unread count response: %v", err)
+	}
+}
+
+// setInboxState marks events of the channel as read, unread or dismissed,
+// subscribers of the channel receive the inbox event if any state has been changed
+func (h *Handler) setInboxState(w http.ResponseWriter, r *http.Request) {
+	channelID := chi.URLParam(r, "channel")
+	log := h.requestLog(r).With(Fields{"channel": channelID})
+
+	req := InboxStateRequest{}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		log.Debugf("decode json: %v", err)
+		http.Error(w, "Malformed JSON", http.StatusBadRequest)
+		return
+	}
+	if err := req.State.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.All == (len(req.IDs) > 0) {
+		http.Error(w, "Either ids or all must be set", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxInboxStateIDs {
+		http.Error(w, fmt.Sprintf("Too many ids, maximum is %d", maxInboxStateIDs), http.StatusBadRequest)
+		return
+	}
+	ids := make([]int64, 0, len(req.IDs))
+	for _, v := range req.IDs {
+		id, err := parseEventID(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Wrong event id %q", v), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	change, err := h.inbox.SetState(channelID, ids, req.State)
+	if err != nil {
+		log.Errorf("set inbox state: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.With(Fields{"event": "inbox_state_changed", "state": req.State}).Debugf("channel %s: %d events are %s", channelID, len(change.IDs), req.State)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(change); err != nil {
+		log.Errorf("encode inbox state response: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInboxHandlers(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+	var ids []string
+	for _, title := range []string{"1", "2", "3"} {
+		ids = append(ids, formatEventID(publish(t, sse, "user_1", title).ID))
+	}
+
+	unread := func() int {
+		t.Helper()
+		resp := UnreadCountResponse{}
+		if w := getJSON(t, router, http.MethodGet, "/inbox/user_1/unread", &resp); w.Code != http.StatusOK {
+			t.Fatalf("unread count: status %d, %s", w.Code, w.Body.String())
+		}
+		return resp.Unread
+	}
+	if n := unread(); n != 3 {
+		t.Fatalf("got %d unread events, want 3", n)
+	}
+
+	change := InboxChange{}
+	if w := postJSON(t, router, "/inbox/user_1/state", `{"ids":["`+ids[0]+`","`+ids[1]+`"],"state":"read"}`, &change); w.Code != http.StatusOK {
+		t.Fatalf("set state: status %d, %s", w.Code, w.Body.String())
+	}
+	if change.Unread != 1 || len(change.IDs) != 2 {
+		t.Errorf("got change %+v, want 2 events read and 1 unread", change)
+	}
+	if w := postJSON(t, router, "/inbox/user_1/state", `{"ids":["`+ids[1]+`"],"state":"dismissed"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("set state: status %d, %s", w.Code, w.Body.String())
+	}
+
+	resp := InboxResponse{}
+	if w := getJSON(t, router, http.MethodGet, "/inbox/user_1/?order=asc", &resp); w.Code != http.StatusOK {
+		t.Fatalf("inbox: status %d, %s", w.Code, w.Body.String())
+	}
+	want := []InboxState{InboxRead, InboxDismissed, InboxUnread}
+	if len(resp.Items) != len(want) || resp.Unread != 1 {
+		t.Fatalf("got inbox %+v, want %d items and 1 unread", resp, len(want))
+	}
+	for i, item := range resp.Items {
+		if item.ID != ids[i] || item.State != want[i] {
+			t.Errorf("item %d: got %s %s, want %s %s", i, item.ID, item.State, ids[i], want[i])
+		}
+	}
+
+	if w := postJSON(t, router, "/inbox/user_1/state", `{"all":true,"state":"read"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("set state of all events: status %d, %s", w.Code, w.Body.String())
+	}
+	if n := unread(); n != 0 {
+		t.Errorf("got %d unread events after all are read, want 0", n)
+	}
+
+	for _, body := range []string{
+		`{"ids":["` + ids[0] + `"],"state":"archived"}`,
+		`{"all":true,"ids":["` + ids[0] + `"],"state":"read"}`,
+		`{"state":"read"}`,
+		`{"ids":["x"],"state":"read"}`,
+		`{`,
+	} {
+		if w := postJSON(t, router, "/inbox/user_1/state", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// slowInboxStorage takes a while to read states, so concurrent changes overlap
+type slowInboxStorage struct {
+	*MemStorage
+}
+
+func (s slowInboxStorage) GetInboxStates(channelID string) (map[int64]InboxState, error) {
+	time.Sleep(time.Millisecond)
+	return s.MemStorage.GetInboxStates(channelID)
+}
+
+func TestInboxConcurrentStateChanges(t *testing.T) {
+	h, sse := newTestHandler(t, slowInboxStorage{NewMemStorage()})
+	const n = 20
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = publish(t, sse, "user_1", "title").ID
+	}
+
+	// every change reads one event, so each of them must report its own unread count
+	counts := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			change, err := h.inbox.SetState("User_1", []int64{ids[i]}, InboxRead)
+			if err != nil {
+				t.Error(err)
+			}
+			counts[i] = change.Unread
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Ints(counts)
+	for i, count := range counts {
+		if count != i {
+			t.Fatalf("got unread counts %v, want each of 0..%d once", counts, n-1)
+		}
+	}
+	if len(h.inbox.locks) != 0 {
+		t.Errorf("%d channel locks are left", len(h.inbox.locks))
+	}
+}
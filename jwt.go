@@ -0,0 +1,487 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/jwtauth"
+)
+
+const (
+	defaultJWKSRefreshInterval = time.Hour
+	// unknown key id triggers refresh of the key set, but not more often than this
+	minJWKSRefreshInterval = 30 * time.Second
+)
+
+type (
+	// JWTVerifier verifies tokens signed either with shared secret (HS256)
+	// or with private keys which public part is loaded from PEM files or JWKS document
+	JWTVerifier struct {
+		parser *jwt.Parser
+		secret []byte
+		// template of channels granted to the subject, see grantedChannels
+		channelTemplate string
+		// required "iss" and "aud" claims, empty ones are not checked
+		issuer   string
+		audience string
+
+		sync.RWMutex
+		// public keys by key id, key with empty id is used for tokens without "kid" header
+		keys map[string]crypto.PublicKey
+		// keys loaded from JWKS document, replaced on every refresh
+		jwksKeys map[string]crypto.PublicKey
+		jwks     *JWKSSource
+		// time of the last attempt to load JWKS document
+		refreshedAt time.Time
+		// closed when the refresh caused by unknown key id is done, nil if there is no such refresh
+		refreshing chan struct{}
+	}
+
+	// JWKSSource is a location of JWKS document, either file path or http(s) url
+	JWKSSource struct {
+		Location string
+		Client   *http.Client
+		// keys which can't be used are skipped and reported to the log, if it's set
+		Log Logger
+	}
+
+	jwkSet struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+// NewJWTVerifier is a factory func, returns a new instance of the JWTVerifier structure.
+// Algorithms is a list of accepted signing algorithms, e.g.: HS256, RS256, ES256, EdDSA.
+func NewJWTVerifier(algorithms []string, secret []byte) *JWTVerifier {
+	return &JWTVerifier{
+		parser: &jwt.Parser{ValidMethods: algorithms},
+		secret: secret,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// NewJWTVerifierFromConfig builds verifier from the configuration,
+// returns nil if jwt authentication isn't configured
+func NewJWTVerifierFromConfig(cfg JWTConfig, log Logger) (*JWTVerifier, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	secret := cfg.Secret
+	keyFile := cfg.PublicKeyFile
+	jwks := cfg.JWKSURL
+	if jwks == "" {
+		jwks = cfg.JWKSFile
+	}
+
+	algorithms := cfg.Algorithms
+	if len(algorithms) == 0 {
+		if secret != "" {
+			algorithms = append(algorithms, "HS256")
+		}
+		if keyFile != "" || jwks != "" {
+			algorithms = append(algorithms, "RS256", "ES256", "EdDSA")
+		}
+	}
+	for _, alg := range algorithms {
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unsupported jwt algorithm: %s", alg)
+		}
+	}
+
+	v := NewJWTVerifier(algorithms, []byte(secret))
+	v.channelTemplate = cfg.ChannelTemplate
+	v.issuer = cfg.Issuer
+	v.audience = cfg.Audience
+	if keyFile != "" {
+		key, err := loadPublicKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load public key %s: %v", keyFile, err)
+		}
+		v.AddKey(cfg.KeyID, key)
+	}
+	if jwks != "" {
+		v.jwks = &JWKSSource{Location: jwks, Client: &http.Client{Timeout: 10 * time.Second}, Log: log}
+		if err := v.RefreshKeys(); err != nil {
+			return nil, fmt.Errorf("load jwks %s: %v", jwks, err)
+		}
+	}
+	return v, nil
+}
+
+// Verify returns middleware which verifies token found by the given functions,
+// result is stored in the request context the same way as jwtauth.Verify does,
+// so jwtauth.Authenticator and jwtauth.FromContext can be used with it
+func (v *JWTVerifier) Verify(findTokenFns ...func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := v.VerifyRequest(r, findTokenFns...)
+			ctx := jwtauth.NewContext(r.Context(), token, err)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// VerifyRequest finds token in the request and verifies it
+func (v *JWTVerifier) VerifyRequest(r *http.Request, findTokenFns ...func(r *http.Request) string) (*jwt.Token, error) {
+	var tokenStr string
+	for _, fn := range findTokenFns {
+		if tokenStr = fn(r); tokenStr != "" {
+			break
+		}
+	}
+	if tokenStr == "" {
+		return nil, jwtauth.ErrNoTokenFound
+	}
+
+	token, err := v.parser.Parse(tokenStr, v.keyFunc)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return token, jwtauth.ErrExpired
+		}
+		return token, err
+	}
+	if !token.Valid {
+		return token, jwtauth.ErrUnauthorized
+	}
+	if err := v.verifyClaims(token); err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+// verifyClaims checks issuer and audience of the token, if they are configured
+func (v *JWTVerifier) verifyClaims(token *jwt.Token) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return jwtauth.ErrUnauthorized
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("token issuer %q isn't accepted", iss)
+		}
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return errors.New("token isn't intended for this audience")
+	}
+	return nil
+}
+
+// hasAudience reports whether "aud" claim, either a string or a list of strings, contains the audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddKey adds public key to the verifier
+func (v *JWTVerifier) AddKey(kid string, key crypto.PublicKey) {
+	v.Lock()
+	defer v.Unlock()
+	v.keys[kid] = key
+}
+
+// RefreshKeys reloads keys from the JWKS document
+func (v *JWTVerifier) RefreshKeys() error {
+	if v.jwks == nil {
+		return nil
+	}
+	v.Lock()
+	v.refreshedAt = time.Now()
+	v.Unlock()
+	return v.loadKeys()
+}
+
+// refreshUnknownKey reloads keys from the JWKS document because of unknown key id,
+// but not more often than minJWKSRefreshInterval. The attempt is recorded before the document is loaded,
+// so concurrent requests with unknown key id wait for the same refresh instead of loading the document again.
+func (v *JWTVerifier) refreshUnknownKey() error {
+	v.Lock()
+	if done := v.refreshing; done != nil {
+		v.Unlock()
+		<-done
+		return nil
+	}
+	if time.Since(v.refreshedAt) <= minJWKSRefreshInterval {
+		v.Unlock()
+		return nil
+	}
+	v.refreshedAt = time.Now()
+	done := make(chan struct{})
+	v.refreshing = done
+	v.Unlock()
+
+	err := v.loadKeys()
+
+	v.Lock()
+	v.refreshing = nil
+	v.Unlock()
+	close(done)
+	return err
+}
+
+func (v *JWTVerifier) loadKeys() error {
+	keys, err := v.jwks.Load()
+	if err != nil {
+		return err
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.jwksKeys = keys
+	return nil
+}
+
+// RunKeysRefresh periodically reloads keys from the JWKS document, it blocks until stop is closed
+func (v *JWTVerifier) RunKeysRefresh(interval time.Duration, log Logger, stop <-chan struct{}) {
+	if v.jwks == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultJWKSRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := v.RefreshKeys(); err != nil {
+				log.Errorf("refresh jwks %s: %v", v.jwks.Location, err)
+			}
+		}
+	}
+}
+
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(v.secret) == 0 {
+			return nil, errors.New("hmac signed tokens are not accepted")
+		}
+		return v.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := v.key(kid)
+	if !ok && v.jwks != nil {
+		// key might have been rotated
+		if err := v.refreshUnknownKey(); err != nil {
+			return nil, err
+		}
+		key, ok = v.key(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	case *SigningMethodEdDSA:
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key %q can't be used with %s algorithm", kid, token.Method.Alg())
+}
+
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, bool) {
+	v.RLock()
+	defer v.RUnlock()
+	if key, ok := v.jwksKeys[kid]; ok {
+		return key, true
+	}
+	// the only key in JWKS document is used for tokens without "kid" header
+	if kid == "" && len(v.jwksKeys) == 1 {
+		for _, key := range v.jwksKeys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// Load reads JWKS document and returns public keys by key id,
+// keys of unsupported types or curves are skipped, so they don't prevent use of the other keys
+func (s *JWKSSource) Load() (map[string]crypto.PublicKey, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if strings.HasPrefix(s.Location, "http://") || strings.HasPrefix(s.Location, "https://") {
+		b, err = s.fetch()
+	} else {
+		b, err = ioutil.ReadFile(s.Location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	set := jwkSet{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("decode jwks: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			if s.Log != nil {
+				s.Log.Warnf("jwks %s: skip key %q: %v", s.Location, k.Kid, err)
+			}
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys in jwks")
+	}
+	return keys, nil
+}
+
+func (s *JWKSSource) fetch() ([]byte, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(s.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// loadPublicKey reads RSA, ECDSA or Ed25519 public key from PEM file,
+// the file may contain either public key or certificate
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported pem block type: %s", block.Type)
+}
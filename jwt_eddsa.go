@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements EdDSA (Ed25519) signing method, which jwt-go doesn't support.
+// Expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification.
+type SigningMethodEdDSA struct{}
+
+// ErrEdDSAVerification is returned when signature is invalid
+var ErrEdDSAVerification = errors.New("ed25519: verification error")
+
+func init() {
+	method := &SigningMethodEdDSA{}
+	jwt.RegisterSigningMethod(method.Alg(), func() jwt.SigningMethod {
+		return method
+	})
+}
+
+// Alg returns name of the algorithm
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify checks signature of the signing string
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return ErrEdDSAVerification
+	}
+	return nil
+}
+
+// Sign returns encoded signature of the signing string
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// jwksServer serves JWKS document which can be replaced by the test
+type jwksServer struct {
+	*httptest.Server
+	sync.Mutex
+	doc      []byte
+	status   int
+	requests int
+	// requests wait until it's closed, if it's set
+	release chan struct{}
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk) *jwksServer {
+	s := &jwksServer{}
+	s.setKeys(t, keys...)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		s.requests++
+		release := s.release
+		s.Unlock()
+		if release != nil {
+			<-release
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			return
+		}
+		w.Write(s.doc)
+	}))
+	return s
+}
+
+func (s *jwksServer) setKeys(t *testing.T, keys ...jwk) {
+	b, err := json.Marshal(jwkSet{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.doc = b
+	s.status = 0
+}
+
+func (s *jwksServer) fail(status int) {
+	s.Lock()
+	defer s.Unlock()
+	s.status = status
+}
+
+// pause holds requests until the returned func is called
+func (s *jwksServer) pause() func() {
+	s.Lock()
+	defer s.Unlock()
+	release := make(chan struct{})
+	s.release = release
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		s.release = nil
+		close(release)
+	}
+}
+
+func (s *jwksServer) requestsCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests
+}
+
+// testKey is a private key with its public part in JWKS format
+type testKey struct {
+	method jwt.SigningMethod
+	key    crypto.PrivateKey
+	jwk    jwk
+}
+
+func newRSAKey(t *testing.T, kid string) testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{jwt.SigningMethodRS256, key, jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func newECKey(t *testing.T, kid string) testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{jwt.SigningMethodES256, key, jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}}
+}
+
+func newEdKey(t *testing.T, kid string) testKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{&SigningMethodEdDSA{}, private, jwk{
+		Kty: "OKP",
+		Kid: kid,
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(public),
+	}}
+}
+
+func (k testKey) sign(t *testing.T, sub string) string {
+	token := jwt.NewWithClaims(k.method, jwt.MapClaims{
+		"sub": sub,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	if k.jwk.Kid != "" {
+		token.Header["kid"] = k.jwk.Kid
+	}
+	s, err := token.SignedString(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// verify checks token the same way as middleware does
+func verify(v *JWTVerifier, token string) error {
+	r := httptest.NewRequest(http.MethodGet, "/sub/ch?token="+token, nil)
+	_, err := v.VerifyRequest(r, tokenFromQuery)
+	return err
+}
+
+func newJWKSVerifier(t *testing.T, url string) *JWTVerifier {
+	t.Helper()
+	v, err := NewJWTVerifierFromConfig(JWTConfig{JWKSURL: url}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestJWKSAlgorithms(t *testing.T) {
+	keys := []testKey{newRSAKey(t, "rsa"), newECKey(t, "ec"), newEdKey(t, "ed")}
+	srv := newJWKSServer(t, keys[0].jwk, keys[1].jwk, keys[2].jwk)
+	defer srv.Close()
+	v := newJWKSVerifier(t, srv.URL)
+
+	for _, k := range keys {
+		if err := verify(v, k.sign(t, "user")); err != nil {
+			t.Errorf("%s: %v", k.method.Alg(), err)
+		}
+	}
+
+	// token signed by another key with the same id is rejected
+	forged := newRSAKey(t, "rsa")
+	if err := verify(v, forged.sign(t, "user")); err == nil {
+		t.Error("token signed with unknown key has been accepted")
+	}
+	// key can't be used with algorithm of another type
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"})
+	hs.Header["kid"] = "rsa"
+	token, _ := hs.SignedString([]byte("secret"))
+	if err := verify(v, token); err == nil {
+		t.Error("hmac signed token has been accepted")
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	old, rotated := newRSAKey(t, "2020"), newECKey(t, "2021")
+	srv := newJWKSServer(t, old.jwk)
+	defer srv.Close()
+	v := newJWKSVerifier(t, srv.URL)
+
+	if err := verify(v, old.sign(t, "user")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.setKeys(t, rotated.jwk)
+	// the key set has been loaded recently, so unknown key id doesn't cause refresh
+	if err := verify(v, rotated.sign(t, "user")); err == nil {
+		t.Fatal("token signed with the key which isn't loaded yet has been accepted")
+	}
+	if n := srv.requestsCount(); n != 1 {
+		t.Fatalf("jwks has been requested %d times, want 1", n)
+	}
+
+	// unknown key id causes refresh when the rate limit allows it
+	v.refreshedAt = time.Now().Add(-2 * minJWKSRefreshInterval)
+	if err := verify(v, rotated.sign(t, "user")); err != nil {
+		t.Fatalf("token signed with rotated key: %v", err)
+	}
+	if err := verify(v, old.sign(t, "user")); err == nil {
+		t.Error("token signed with the removed key has been accepted")
+	}
+	// the next unknown key id is within the rate limit
+	if err := verify(v, newEdKey(t, "2022").sign(t, "user")); err == nil {
+		t.Error("token signed with unknown key has been accepted")
+	}
+	if n := srv.requestsCount(); n != 2 {
+		t.Errorf("jwks has been requested %d times, want 2", n)
+	}
+}
+
+func TestJWKSFailedRefreshKeepsKeys(t *testing.T) {
+	key := newECKey(t, "ec")
+	srv := newJWKSServer(t, key.jwk)
+	defer srv.Close()
+	v := newJWKSVerifier(t, srv.URL)
+
+	srv.fail(http.StatusInternalServerError)
+	if err := v.RefreshKeys(); err == nil {
+		t.Fatal("refresh hasn't failed")
+	}
+	if err := verify(v, key.sign(t, "user")); err != nil {
+		t.Errorf("key has been lost after failed refresh: %v", err)
+	}
+
+	srv.setKeys(t)
+	if err := v.RefreshKeys(); err == nil {
+		t.Fatal("refresh with empty key set hasn't failed")
+	}
+	if err := verify(v, key.sign(t, "user")); err != nil {
+		t.Errorf("key has been lost after refresh with empty key set: %v", err)
+	}
+}
+
+func TestJWKSSkipsUnsupportedKeys(t *testing.T) {
+	key := newEdKey(t, "ed")
+	srv := newJWKSServer(t,
+		jwk{Kty: "oct", Kid: "symmetric"},
+		jwk{Kty: "EC", Kid: "secp256k1", Crv: "secp256k1"},
+		jwk{Kty: "RSA", Kid: "encryption", Use: "enc"},
+		key.jwk,
+	)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, "text", DebugLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := (&JWKSSource{Location: srv.URL, Log: log}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["ed"] == nil {
+		t.Errorf("got keys %v, want only ed", keys)
+	}
+	for _, kid := range []string{"symmetric", "secp256k1"} {
+		if !strings.Contains(buf.String(), `skip key "`+kid+`"`) {
+			t.Errorf("skipped key %s hasn't been logged: %s", kid, buf.String())
+		}
+	}
+
+	// the only key is used for tokens without key id
+	v := newJWKSVerifier(t, srv.URL)
+	key.jwk.Kid = ""
+	if err := verify(v, key.sign(t, "user")); err != nil {
+		t.Errorf("token without key id: %v", err)
+	}
+}
+
+func TestJWKSConcurrentRefresh(t *testing.T) {
+	old, rotated := newRSAKey(t, "2020"), newECKey(t, "2021")
+	srv := newJWKSServer(t, old.jwk)
+	defer srv.Close()
+	v := newJWKSVerifier(t, srv.URL)
+	srv.setKeys(t, rotated.jwk)
+	v.refreshedAt = time.Now().Add(-2 * minJWKSRefreshInterval)
+
+	release := srv.pause()
+	token := rotated.sign(t, "user")
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- verify(v, token)
+		}()
+	}
+	// requests with unknown key id wait for the refresh which is in progress
+	for srv.requestsCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	release()
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("token signed with rotated key: %v", err)
+		}
+	}
+	if n := srv.requestsCount(); n != 2 {
+		t.Errorf("jwks has been requested %d times, want 2", n)
+	}
+}
+
+func TestJWTIssuerAndAudience(t *testing.T) {
+	v, err := NewJWTVerifierFromConfig(JWTConfig{Secret: "secret", Issuer: "https://auth.example.com", Audience: "notifications"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{"expected claims", jwt.MapClaims{"iss": "https://auth.example.com", "aud": "notifications"}, false},
+		{"one of audiences", jwt.MapClaims{"iss": "https://auth.example.com", "aud": []interface{}{"billing", "notifications"}}, false},
+		{"another issuer", jwt.MapClaims{"iss": "https://evil.example.com", "aud": "notifications"}, true},
+		{"without issuer", jwt.MapClaims{"aud": "notifications"}, true},
+		{"another audience", jwt.MapClaims{"iss": "https://auth.example.com", "aud": "billing"}, true},
+		{"other audiences", jwt.MapClaims{"iss": "https://auth.example.com", "aud": []interface{}{"billing"}}, true},
+		{"without audience", jwt.MapClaims{"iss": "https://auth.example.com"}, true},
+	}
+	for _, tt := range tests {
+		if err := verify(v, signHS256(t, "secret", tt.claims)); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// claims are not checked if they are not configured
+	v, err = NewJWTVerifierFromConfig(JWTConfig{Secret: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(v, signHS256(t, "secret", jwt.MapClaims{"iss": "anyone"})); err != nil {
+		t.Errorf("token without configured claims: %v", err)
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type (
@@ -20,73 +27,251 @@ type (
 		Fatalf(format string, v ...interface{})
 		Panic(v interface{})
 		Panicf(format string, v ...interface{})
+		// With returns logger which adds given fields to every message
+		With(fields Fields) Logger
+		// Enabled reports whether messages of the level are written,
+		// so fields of frequent debug messages are built only if they are written
+		Enabled(level Level) bool
 	}
 
+	// Fields of the structured log message, e.g. request_id, channel, event_id.
+	// Field "event" is a stable name of what happened, e.g. client_connected.
+	Fields map[string]interface{}
+
+	// Level of the log message
+	Level int
+
 	logger struct {
+		out    *syncWriter
+		level  Level
+		json   bool
+		fields Fields
+	}
+
+	syncWriter struct {
+		sync.Mutex
+		w io.Writer
 	}
 )
 
-// NewLogger return new instance of logger
-func NewLogger() Logger {
-	return &logger{}
+// Levels of log messages
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+	PanicLevel
+)
+
+// Formats of log messages
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal", "panic"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > PanicLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns level by its name, empty name is the info level
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return InfoLevel, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+// NewLogger return new instance of logger,
+// which writes messages of the given level and above in json or text format
+func NewLogger(out io.Writer, format string, level Level) (Logger, error) {
+	switch format {
+	case "", LogFormatJSON, LogFormatText:
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return &logger{
+		out:   &syncWriter{w: out},
+		level: level,
+		json:  format != LogFormatText,
+	}, nil
+}
+
+// With returns logger which adds given fields to every message
+func (l *logger) With(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{
+		out:    l.out,
+		level:  l.level,
+		json:   l.json,
+		fields: merged,
+	}
+}
+
+// Enabled reports whether messages of the level are written
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.level
 }
 
 // Debug func
 func (l *logger) Debug(v interface{}) {
-	log.Println(fmt.Sprintf("[debug] %v", v))
+	l.log(DebugLevel, fmt.Sprint(v))
 }
 
 // Debugf func
 func (l *logger) Debugf(format string, v ...interface{}) {
-	log.Printf("[debug] %s", fmt.Sprintf(format, v...))
+	if l.level <= DebugLevel {
+		l.log(DebugLevel, fmt.Sprintf(format, v...))
+	}
 }
 
 // Info func
 func (l *logger) Info(v interface{}) {
-	log.Println(fmt.Sprintf("[info] %v", v))
+	l.log(InfoLevel, fmt.Sprint(v))
 }
 
 // Infof func
 func (l *logger) Infof(format string, v ...interface{}) {
-	log.Printf("[info] %s", fmt.Sprintf(format, v...))
+	if l.level <= InfoLevel {
+		l.log(InfoLevel, fmt.Sprintf(format, v...))
+	}
 }
 
 // Warn func
 func (l *logger) Warn(v interface{}) {
-	log.Println(fmt.Sprintf("[warn] %v", v))
+	l.log(WarnLevel, fmt.Sprint(v))
 }
 
 // Warnf func
 func (l *logger) Warnf(format string, v ...interface{}) {
-	log.Printf("[warn] %s", fmt.Sprintf(format, v...))
+	if l.level <= WarnLevel {
+		l.log(WarnLevel, fmt.Sprintf(format, v...))
+	}
 }
 
 // Error func
 func (l *logger) Error(v interface{}) {
-	log.Println(fmt.Sprintf("[error] %v", v))
+	l.log(ErrorLevel, fmt.Sprint(v))
 }
 
 // Errorf func
 func (l *logger) Errorf(format string, v ...interface{}) {
-	log.Printf("[error] %s", fmt.Sprintf(format, v...))
+	l.log(ErrorLevel, fmt.Sprintf(format, v...))
 }
 
 // Fatal func
 func (l *logger) Fatal(v interface{}) {
-	log.Fatalln(fmt.Sprintf("[fatal] %v", v))
+	l.log(FatalLevel, fmt.Sprint(v))
+	os.Exit(1)
 }
 
 // Fatalf func
 func (l *logger) Fatalf(format string, v ...interface{}) {
-	log.Fatalf("[fatal] %s", fmt.Sprintf(format, v...))
+	l.log(FatalLevel, fmt.Sprintf(format, v...))
+	os.Exit(1)
 }
 
 // Panic func
 func (l *logger) Panic(v interface{}) {
-	log.Panicln(fmt.Sprintf("[panic] %v", v))
+	msg := fmt.Sprint(v)
+	l.log(PanicLevel, msg)
+	panic(msg)
 }
 
 // Panicf func
 func (l *logger) Panicf(format string, v ...interface{}) {
-	log.Panicf("[panic] %s", fmt.Sprintf(format, v...))
+	msg := fmt.Sprintf(format, v...)
+	l.log(PanicLevel, msg)
+	panic(msg)
+}
+
+func (l *logger) log(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	if l.json {
+		l.formatJSON(buf, now, level, msg)
+	} else {
+		l.formatText(buf, now, level, msg)
+	}
+	l.out.Write(buf.Bytes())
+}
+
+// formatJSON writes message as a single line json object, fields are sorted by name
+func (l *logger) formatJSON(buf *bytes.Buffer, t time.Time, level Level, msg string) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, t.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for _, k := range l.fieldNames() {
+		if k == "time" || k == "level" || k == "msg" {
+			continue
+		}
+		buf.WriteByte(',')
+		writeJSONValue(buf, k)
+		buf.WriteByte(':')
+		writeJSONValue(buf, l.fields[k])
+	}
+	buf.WriteString("}\n")
+}
+
+// formatText writes message in the legacy format: "time [level] [event] message key=value ..."
+func (l *logger) formatText(buf *bytes.Buffer, t time.Time, level Level, msg string) {
+	fmt.Fprintf(buf, "%s [%s] ", t.Format("2006/01/02 15:04:05"), level)
+	if event, ok := l.fields["event"]; ok {
+		fmt.Fprintf(buf, "[%v] ", event)
+	}
+	buf.WriteString(msg)
+	for _, k := range l.fieldNames() {
+		if k != "event" {
+			fmt.Fprintf(buf, " %s=%v", k, l.fields[k])
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+func (l *logger) fieldNames() []string {
+	names := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	buf.Write(b)
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.w.Write(p)
 }
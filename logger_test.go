@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+func TestLoggerJSONFields(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, LogFormatJSON, DebugLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := log.With(Fields{"request_id": "r1", "channel": "ch"})
+	request.With(Fields{"event": "client_connected", "channel": "other", "err": errors.New("boom")}).Infof("client %s", "connected")
+	// fields of the parent logger are not changed by child ones
+	request.Warnf("parent")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %s", len(lines), buf.String())
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &msg); err != nil {
+		t.Fatalf("decode %s: %v", lines[0], err)
+	}
+	want := map[string]interface{}{
+		"level":      "info",
+		"msg":        "client connected",
+		"event":      "client_connected",
+		"request_id": "r1",
+		"channel":    "other",
+		"err":        "boom",
+	}
+	for k, v := range want {
+		if msg[k] != v {
+			t.Errorf("field %s = %v, want %v", k, msg[k], v)
+		}
+	}
+	if _, ok := msg["time"]; !ok {
+		t.Error("time is missed")
+	}
+	var parent map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &parent); err != nil {
+		t.Fatalf("decode %s: %v", lines[1], err)
+	}
+	if parent["channel"] != "ch" || parent["event"] != nil {
+		t.Errorf("fields of parent logger: %v", parent)
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, LogFormatText, InfoLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.With(Fields{"event": "client_evicted", "dropped": 3, "channel": "ch"}).Warnf("slow client")
+	if got, want := buf.String(), "[warn] [client_evicted] slow client channel=ch dropped=3\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, LogFormatJSON, WarnLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Debugf("debug")
+	log.With(Fields{"event": "x"}).Infof("info")
+	log.Warnf("warn")
+	log.Errorf("error")
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("got %d messages, want 2: %s", n, buf.String())
+	}
+	for level, want := range map[Level]bool{DebugLevel: false, InfoLevel: false, WarnLevel: true, ErrorLevel: true} {
+		if got := log.With(Fields{"channel": "ch"}).Enabled(level); got != want {
+			t.Errorf("Enabled(%s) = %v, want %v", level, got, want)
+		}
+	}
+
+	if _, err := NewLogger(&buf, "xml", InfoLevel); err == nil {
+		t.Error("unknown format is accepted")
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("unknown level is accepted")
+	}
+	if level, err := ParseLevel(""); err != nil || level != InfoLevel {
+		t.Errorf("default level = %s, %v", level, err)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, LogFormatJSON, InfoLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := middleware.RequestID(requestLogger(log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sub/ch?token=secret-jwt&last_event_id=1", nil))
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("decode %s: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"event":  "http_request",
+		"method": http.MethodGet,
+		"path":   "/sub/ch",
+		"status": float64(http.StatusTeapot),
+		"bytes":  float64(len("short and stout")),
+		"msg":    "GET /sub/ch",
+	}
+	for k, v := range want {
+		if msg[k] != v {
+			t.Errorf("field %s = %v, want %v", k, msg[k], v)
+		}
+	}
+	for _, k := range []string{"request_id", "duration_ms", "remote_addr"} {
+		if _, ok := msg[k]; !ok {
+			t.Errorf("field %s is missed", k)
+		}
+	}
+	// tokens are passed in the query string, so it's never logged
+	if strings.Contains(buf.String(), "secret-jwt") || strings.Contains(buf.String(), "last_event_id") {
+		t.Errorf("query string is logged: %s", buf.String())
+	}
+}
@@ -1,28 +1,49 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
-	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Storage instance
 var storageInstance Storage
 
-// Waitgroup
-var wg sync.WaitGroup
+// time to finish processing of requests on shutdown
+const defaultShutdownTimeout = 10 * time.Second
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to yaml configuration file")
+	printConfig := flag.Bool("print-config", false, "print effective configuration with secrets redacted and exit")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if *printConfig {
+		if b, err := cfg.Redacted(); err == nil {
+			os.Stdout.Write(b)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		return
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
 	// Set max process number
 	n := 1
 	if runtime.NumCPU() > 3 {
@@ -30,57 +51,145 @@ func main() {
 	}
 	runtime.GOMAXPROCS(n)
 
-	logger := NewLogger()
+	logLevel, _ := ParseLevel(cfg.Log.Level)
+	logger, err := NewLogger(os.Stderr, cfg.Log.Format, logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
 	logger.Debugf("start running on %d cpu", n)
 
-	// Init in-memory storage
-	storageInstance = NewMemStorage()
+	// Init storage and relay of published events
+	overflowPolicy, _ := ParseOverflowPolicy(cfg.Limits.SubscriberOverflowPolicy)
+	hub := NewHub(cfg.Limits.SubscriberQueueSize, overflowPolicy)
+	relay := NewLocalRelay(hub)
+	// signatures of publish requests are remembered by this instance, unless they are shared in redis
+	var replays ReplayCache
+	switch cfg.Storage.Driver {
+	case "memory":
+		storageInstance = NewMemStorage()
+	case "bolt":
+		bs, err := NewBoltStorage(cfg.Storage.BoltPath)
+		if err != nil {
+			logger.Fatalf("open bolt storage %s: %v", cfg.Storage.BoltPath, err)
+		}
+		storageInstance = bs
+	case "redis":
+		client, err := NewRedisClient(cfg.Storage.RedisURL)
+		if err != nil {
+			logger.Fatalf("connect to redis: %v", err)
+		}
+		defer client.Close()
+		storageInstance = NewRedisStorage(client, cfg.Storage.RedisPrefix)
+
+		// events published on any instance are delivered to listeners of all instances
+		rr := NewRedisRelay(client, cfg.Storage.RedisPrefix, hub)
+		defer rr.Close()
+		go func() {
+			if err := rr.Run(logger); err != nil {
+				logger.Errorf("redis relay: %v", err)
+			}
+		}()
+		relay = rr
+		replays = NewRedisReplayCache(client, cfg.Storage.RedisPrefix)
+	}
+
+	// per-channel metrics are labelled by the configured prefixes of channel ids
+	metricsChannelPrefixes = cfg.Metrics.ChannelPrefixes
+
+	// storage statistics are exposed by the metrics endpoint
+	prometheus.MustRegister(NewStorageCollector(storageInstance))
 
 	// Set up router
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(requestLogger(logger))
 	r.Use(middleware.Recoverer)
 
-	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-	ao := []string{"*"}
-	if allowedOrigins != "" {
-		ao = strings.Split(allowedOrigins, ",")
+	corsHandler := NewCORS(cfg.CORS.AllowedOrigins)
+	r.Use(corsHandler.Handler)
+
+	auth, err := NewAuth(cfg.Auth, logger)
+	if err != nil {
+		logger.Fatalf("auth: %v", err)
 	}
-	r.Use(cors.New(cors.Options{
-		AllowedOrigins:   ao,
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID", "Origin"},
-		AllowCredentials: true,
-		MaxAge:           10080, // Maximum value not ignored by any of major browsers
-	}).Handler)
+	if replays != nil {
+		// the cache is shared with settings loaded by reload, see ShareReplays
+		auth.Signatures.SetReplayCache(replays)
+	}
+	auth.Start(logger)
+
+	sseInstance := NewSSE(storageInstance, hub, relay, time.Duration(cfg.GC.MaxAge))
+	// lag of at-least-once consumers is exposed by the metrics endpoint
+	prometheus.MustRegister(sseInstance.acks)
+
+	handler := NewHandler(logger, sseInstance, auth, cfg.Stream)
+	handler.SetCORS(corsHandler)
+	r.Mount("/", handler.Router())
 
-	r.Mount("/", NewHandler(logger, NewSSE(storageInstance)).Router())
+	// auth and cors settings are reloaded on SIGHUP or by request of admin
+	reloader := NewReloader(*configPath, cfg, handler, corsHandler, logger)
+	handler.OnReload(reloader.Reload)
+	go reloader.Watch()
 
 	// Garbage collection
+	stopGC := make(chan struct{})
+	gcDone := make(chan struct{})
 	go func() {
-		storageInstance.GC(os.Getenv("SSE_MAX_AGE"), os.Getenv("GC_PERIOD"), &wg)
+		defer close(gcDone)
+		storageInstance.GC(time.Duration(cfg.GC.MaxAge), time.Duration(cfg.GC.Period), sseInstance.acks.Active, stopGC)
 	}()
 
 	// Server application
-	wg.Add(1)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.Port),
+		Handler: r,
+	}
+	// http/2 multiplexes many event streams over a single connection
+	if err := configureHTTP2(srv, cfg.TLS, logger); err != nil {
+		logger.Fatalf("configure tls: %v", err)
+	}
+	// subscribers are told to reconnect as soon as the server stops accepting new connections
+	srv.RegisterOnShutdown(hub.Shutdown)
 	go func() {
-		logger.Fatalf("server: %+v", http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("APP_PORT")), r))
+		var err error
+		if cfg.TLS.Enabled() {
+			// certificate is provided by tls config, so it can be reloaded
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logger.Fatalf("server: %+v", err)
+		}
 	}()
 
 	// Graceful app shutdown
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
-	go func() {
-		sig := <-gracefulStop
-		logger.Infof("caught sig: %+v", sig)
-		logger.Infof("Wait for 2 second to finish processing")
-		time.Sleep(2 * time.Second)
-		wg.Done()
-	}()
+	sig := <-gracefulStop
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout)
+	logger.Infof("caught sig: %+v", sig)
+	logger.Infof("wait up to %s to finish processing", shutdownTimeout)
 
-	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warnf("server shutdown: %v", err)
+		srv.Close()
+	}
+	// websocket connections are hijacked, so server doesn't wait for them
+	if err := hub.Wait(ctx); err != nil {
+		logger.Warnf("disconnect subscribers: %v", err)
+	}
+
+	// stop the garbage collector and wait for its current run, so it doesn't touch closed storage
+	close(stopGC)
+	<-gcDone
+	if err := storageInstance.Close(); err != nil {
+		logger.Errorf("close storage: %v", err)
+	}
+	logger.Infof("server stopped")
 }
@@ -14,12 +14,18 @@ const (
 type MemStorage struct {
 	sync.RWMutex
 	events map[string][]Event
+	// the last id used in any channel
+	lastID int64
+	states map[string]map[int64]InboxState
+	acks   map[string]map[string]*AckState
 }
 
 // NewMemStorage is a factory func, returns a new instance of the MemStorage structure
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
 		events: make(map[string][]Event, defaultChannelLength),
+		states: make(map[string]map[int64]InboxState),
+		acks:   make(map[string]map[string]*AckState),
 	}
 }
 
@@ -38,19 +44,84 @@ func (s *MemStorage) GetByLastID(channelID string, lastEventID int64) []Event {
 	s.RLock()
 	defer s.RUnlock()
 
-	events, ok := s.events[channelID]
-	if !ok {
+	events := s.events[channelID]
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].ID > lastEventID
+	})
+	if i == len(events) {
 		return nil
 	}
+	return events[i:]
+}
 
-	i := positionGt(events, lastEventID)
-	if i >= 0 && i < len(events) {
-		return events[i+1:]
-	} else if i == -2 {
-		return events
+// GetLast returns the most recent events in a channel, up to given number
+func (s *MemStorage) GetLast(channelID string, n int) ([]Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	events := s.events[channelID]
+	if n <= 0 || len(events) == 0 {
+		return nil, nil
 	}
+	if len(events) > n {
+		return events[len(events)-n:], nil
+	}
+	return events, nil
+}
 
-	return nil
+// GetSince returns events in a channel which have been published at or after given time
+func (s *MemStorage) GetSince(channelID string, since time.Time) ([]Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	t := since.UnixNano()
+	events := s.events[channelID]
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].ID >= t
+	})
+	return publishedSince(events[i:], t), nil
+}
+
+// GetPage returns page of events in a channel
+func (s *MemStorage) GetPage(channelID string, query PageQuery) ([]Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	events := s.events[channelID]
+	lo := sort.Search(len(events), func(i int) bool {
+		return events[i].ID > query.AfterID
+	})
+	hi := len(events)
+	if query.BeforeID > 0 {
+		hi = sort.Search(len(events), func(i int) bool {
+			return events[i].ID >= query.BeforeID
+		})
+	}
+	if query.Limit <= 0 || lo >= hi {
+		return nil, nil
+	}
+
+	n := hi - lo
+	if n > query.Limit {
+		n = query.Limit
+	}
+	page := make([]Event, 0, n)
+	if query.Descending {
+		for i := hi - 1; i >= lo && len(page) < n; i-- {
+			page = append(page, events[i])
+		}
+		return page, nil
+	}
+	return append(page, events[lo:lo+n]...), nil
+}
+
+// NextID returns the next id of event in a channel, the sequence is shared by all channels
+func (s *MemStorage) NextID(channelID string, now int64) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastID = nextEventID(s.lastID, now)
+	return s.lastID, nil
 }
 
 // Add event to storage
@@ -82,72 +153,184 @@ func (s *MemStorage) Delete(channelID string, event Event) error {
 		events = sortEvents(append(events[:i], events[i+1:]...))
 		s.events[channelID] = events
 	}
+	delete(s.states[channelID], event.ID)
 
 	return nil
 }
 
-// GC - garbage collector
-func (s *MemStorage) GC(eventMaxAge, gcPeriod string, wg *sync.WaitGroup) error {
-	if eventMaxAge == "" {
-		eventMaxAge = "1h"
+// SetInboxState sets state of events in a channel, unread state isn't stored
+func (s *MemStorage) SetInboxState(channelID string, ids []int64, state InboxState) error {
+	s.Lock()
+	defer s.Unlock()
+
+	states, ok := s.states[channelID]
+	if !ok {
+		if state == InboxUnread {
+			return nil
+		}
+		states = make(map[int64]InboxState, len(ids))
+		s.states[channelID] = states
+	}
+	for _, id := range ids {
+		if state == InboxUnread {
+			delete(states, id)
+		} else {
+			states[id] = state
+		}
+	}
+	if len(states) == 0 {
+		delete(s.states, channelID)
+	}
+
+	return nil
+}
+
+// GetInboxStates returns states of events in a channel which aren't unread
+func (s *MemStorage) GetInboxStates(channelID string) (map[int64]InboxState, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	res := make(map[int64]InboxState, len(s.states[channelID]))
+	for id, state := range s.states[channelID] {
+		res[id] = state
+	}
+	return res, nil
+}
+
+// RegisterConsumer starts tracking of acknowledgements of the consumer in a channel
+func (s *MemStorage) RegisterConsumer(channelID, consumerID string, from int64) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	state := s.ackState(channelID, consumerID)
+	if state.From == 0 {
+		state.From = from
+	}
+	return state.From, nil
+}
+
+// Ack records acknowledgements of events by the consumer registered in the channel
+func (s *MemStorage) Ack(channelID, consumerID string, ids []int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	state, ok := s.acks[channelID][consumerID]
+	if !ok {
+		return ErrConsumerNotRegistered
 	}
-	maxAge, err := time.ParseDuration(eventMaxAge)
-	if err != nil {
-		return err
+	for _, id := range ids {
+		state.Acked[id] = true
+	}
+	return nil
+}
+
+// GetAckState returns acknowledgements of the consumer in a channel
+func (s *MemStorage) GetAckState(channelID, consumerID string) (AckState, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	res := AckState{Acked: make(map[int64]bool)}
+	if state, ok := s.acks[channelID][consumerID]; ok {
+		res.From = state.From
+		for id := range state.Acked {
+			res.Acked[id] = true
+		}
 	}
+	return res, nil
+}
 
-	if gcPeriod == "" {
-		gcPeriod = "1h"
+// ackState returns acknowledgements of the consumer, it must be called with the lock held
+func (s *MemStorage) ackState(channelID, consumerID string) *AckState {
+	consumers, ok := s.acks[channelID]
+	if !ok {
+		consumers = make(map[string]*AckState)
+		s.acks[channelID] = consumers
 	}
-	period, err := time.ParseDuration(gcPeriod)
-	if err != nil {
-		return err
+	state, ok := consumers[consumerID]
+	if !ok {
+		state = &AckState{Acked: make(map[int64]bool)}
+		consumers[consumerID] = state
 	}
+	return state
+}
 
+// Close does nothing, events are kept in memory only
+func (s *MemStorage) Close() error {
+	return nil
+}
+
+// GC - garbage collector, it runs until stop is closed
+func (s *MemStorage) GC(maxAge, period time.Duration, active ActiveConsumers, stop <-chan struct{}) {
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-stop:
+			return
 		case <-ticker.C:
-			wg.Add(1)
-			s.gc(maxAge)
-			wg.Done()
+			collectGarbage(s.gc, maxAge, active)
 		}
 	}
 }
 
-func (s *MemStorage) gc(maxAge time.Duration) error {
+// Stats returns number of channels and events in storage
+func (s *MemStorage) Stats() (StorageStats, error) {
+	s.RLock()
+	defer s.RUnlock()
+	stats := StorageStats{Channels: len(s.events)}
+	for _, events := range s.events {
+		stats.Events += len(events)
+	}
+	return stats, nil
+}
+
+// gc deletes expired events, returns number of deleted events
+func (s *MemStorage) gc(maxAge time.Duration, active ActiveConsumers) (int, error) {
 	s.RLock()
 	channels := make([]string, 0, len(s.events))
 	for ch := range s.events {
 		channels = append(channels, ch)
 	}
+	// consumers may be registered in channels without events
+	for ch := range s.acks {
+		if _, ok := s.events[ch]; !ok {
+			channels = append(channels, ch)
+		}
+	}
 	s.RUnlock()
 
 	t := time.Now().UnixNano() - maxAge.Nanoseconds()
 
+	removed := 0
 	for _, channelID := range channels {
-		if err := s.deleteBefore(channelID, t); err != nil {
-			return err
+		n, err := s.deleteBefore(channelID, t, active)
+		removed += n
+		if err != nil {
+			return removed, err
 		}
 	}
 
-	return nil
+	return removed, nil
 }
 
-// deleteBefore deletes event which is older then given time
-func (s *MemStorage) deleteBefore(channelID string, t int64) error {
+// deleteBefore deletes event which is older then given time, returns number of deleted events
+func (s *MemStorage) deleteBefore(channelID string, t int64, active ActiveConsumers) (int, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	events, ok := s.events[channelID]
-	if !ok {
-		return nil
+	events := s.events[channelID]
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].ID >= t
+	})
+	// the channel is forgotten when it becomes empty
+	if i == len(events) {
+		delete(s.events, channelID)
+		delete(s.states, channelID)
+		s.forgetConsumers(channelID, t, active)
+		return i, nil
 	}
-
-	i := positionGt(events, t)
-	if i >= 0 {
+	if i > 0 {
 		l := len(events[i:])
 		c := defaultChannelLength
 		if l > c {
@@ -157,8 +340,31 @@ func (s *MemStorage) deleteBefore(channelID string, t int64) error {
 		copy(truncated, events[i:])
 		s.events[channelID] = truncated
 	}
+	for id := range s.states[channelID] {
+		if id < t {
+			delete(s.states[channelID], id)
+		}
+	}
+	for consumerID, state := range s.acks[channelID] {
+		if !active.has(channelID, consumerID) {
+			pruneAckState(state, t)
+		}
+	}
 
-	return nil
+	return i, nil
+}
+
+// forgetConsumers forgets consumers of a channel without events which have been registered before given time,
+// there is nothing to redeliver to them. It must be called with the lock held.
+func (s *MemStorage) forgetConsumers(channelID string, t int64, active ActiveConsumers) {
+	for consumerID, state := range s.acks[channelID] {
+		if state.From < t && !active.has(channelID, consumerID) {
+			delete(s.acks[channelID], consumerID)
+		}
+	}
+	if len(s.acks[channelID]) == 0 {
+		delete(s.acks, channelID)
+	}
 }
 
 // Sort events by id
@@ -188,29 +394,3 @@ func position(a []Event, id int64) (res int) {
 	}
 	return res
 }
-
-func positionGt(a []Event, s int64) (res int) {
-	mid := len(a) / 2
-	switch {
-	case len(a) == 0:
-		res = -1
-	case a[0].ID > s:
-		res = -2
-	case a[0].ID == s:
-		res = 0
-	case a[len(a)-1].ID <= s:
-		res = len(a)
-	case a[mid].ID < s && a[mid+1].ID > s:
-		res = mid + 1
-	case a[mid].ID > s:
-		res = positionGt(a[:mid], s)
-	case a[mid].ID < s:
-		res = positionGt(a[mid+1:], s)
-		if res >= 0 {
-			res += mid + 1
-		}
-	default:
-		res = mid
-	}
-	return res
-}
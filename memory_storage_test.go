@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemStorageGetByLastID(t *testing.T) {
+	s := NewMemStorage()
+	for _, id := range []int64{10, 20, 30, 40} {
+		if err := s.Add("ch", Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		lastID int64
+		want   []int64
+	}{
+		{"no cursor", 0, []int64{10, 20, 30, 40}},
+		{"before the first id", 5, []int64{10, 20, 30, 40}},
+		{"stored id", 20, []int64{30, 40}},
+		// cursor of multi channel subscription may come from another channel
+		{"id which isn't stored", 15, []int64{20, 30, 40}},
+		{"id which isn't stored in the second half", 35, []int64{40}},
+		{"the last id", 40, nil},
+		{"after the last id", 45, nil},
+	}
+	for _, tt := range tests {
+		if got := eventIDs(s.GetByLastID("ch", tt.lastID), 0); !equalIDs(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := s.GetByLastID("nope", 0); len(got) != 0 {
+		t.Errorf("unknown channel: got %v, want nothing", got)
+	}
+}
+
+func TestMemStorageGC(t *testing.T) {
+	s := NewMemStorage()
+	for _, id := range []int64{10, 20, 30} {
+		if _, err := s.NextID("ch", id); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Add("ch", Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetInboxState("ch", []int64{10, 30}, InboxRead); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		before      int64
+		wantRemoved int
+		want        []int64
+	}{
+		{5, 0, []int64{10, 20, 30}},
+		{20, 1, []int64{20, 30}},
+		{25, 1, []int64{30}},
+		{35, 1, nil},
+	}
+	for _, tt := range tests {
+		removed, err := s.deleteBefore("ch", tt.before, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != tt.wantRemoved {
+			t.Errorf("delete before %d: removed %d, want %d", tt.before, removed, tt.wantRemoved)
+		}
+		if got := eventIDs(s.GetAllInChannel("ch"), 0); !equalIDs(got, tt.want) {
+			t.Errorf("delete before %d: left %v, want %v", tt.before, got, tt.want)
+		}
+	}
+	if states, _ := s.GetInboxStates("ch"); len(states) != 0 {
+		t.Errorf("inbox states of deleted events are left: %v", states)
+	}
+	// empty channel is forgotten
+	if stats, _ := s.Stats(); stats.Channels != 0 {
+		t.Errorf("stats %+v, want no channels", stats)
+	}
+}
+
+func TestMemStorageNextID(t *testing.T) {
+	s := NewMemStorage()
+	now := time.Now().UnixNano()
+
+	tests := []struct {
+		name string
+		now  int64
+		want int64
+	}{
+		{"the current time", now, now},
+		{"the same nanosecond", now, now + 1},
+		{"clock went back", now - 100, now + 2},
+		{"clock went forward", now + 100, now + 100},
+	}
+	for _, tt := range tests {
+		id, err := s.NextID("ch", tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, id-now, tt.want-now)
+		}
+	}
+	id, err := s.NextID("other", now-100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now + 101; id != want {
+		t.Errorf("channels share the sequence: got %d, want %d", id-now, want-now)
+	}
+}
+
+func TestMemStorageGCStops(t *testing.T) {
+	s := NewMemStorage()
+	if err := s.Add("ch", Event{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.GC(time.Hour, time.Millisecond, nil, stop)
+	}()
+	deadline := time.After(time.Second)
+	for len(s.GetAllInChannel("ch")) > 0 {
+		select {
+		case <-deadline:
+			t.Fatal("garbage collector hasn't run")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("garbage collector hasn't stopped")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "sse"
+
+// label of per-channel metrics of channels which don't match any of the configured prefixes
+const otherChannelsLabel = "other"
+
+// metricsChannelPrefixes are labels of per-channel metrics, see channelPrefix.
+// They are set from the configuration on start.
+var metricsChannelPrefixes []string
+
+var (
+	connectionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections",
+		Help:      "Number of active subscriber connections by route.",
+	}, []string{"route"})
+
+	publishedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_published_total",
+		Help:      "Number of published events by channel prefix.",
+	}, []string{"prefix"})
+
+	deliveredCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_delivered_total",
+		Help:      "Number of events queued to subscribers by channel prefix.",
+	}, []string{"prefix"})
+
+	droppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_dropped_total",
+		Help:      "Number of events dropped because subscriber queue was full, by channel prefix.",
+	}, []string{"prefix"})
+
+	evictedSubscribersCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscribers_evicted_total",
+		Help:      "Number of slow subscribers disconnected by overflow policy.",
+	})
+
+	publishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "publish_duration_seconds",
+		Help:      "Time spent to publish an event to a channel.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	replaySize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "history_replay_events",
+		Help:      "Number of events replayed from history by last event id.",
+		Buckets:   []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000},
+	})
+
+	ackLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ack_latency_seconds",
+		Help:      "Time from publishing of an event to its acknowledgement by at-least-once consumer.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	gcDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_duration_seconds",
+		Help:      "Duration of storage garbage collector runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	gcEvictedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_evicted_events_total",
+		Help:      "Number of expired events removed from storage by garbage collector.",
+	})
+)
+
+// StorageCollector exposes statistics of the storage on every scrape
+type StorageCollector struct {
+	storage  Storage
+	channels *prometheus.Desc
+	events   *prometheus.Desc
+}
+
+// NewStorageCollector is a factory func, returns a new instance of the StorageCollector structure
+func NewStorageCollector(storage Storage) *StorageCollector {
+	return &StorageCollector{
+		storage: storage,
+		channels: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "storage", "channels"),
+			"Number of channels which have events in storage.", nil, nil,
+		),
+		events: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "storage", "events"),
+			"Total number of events in storage.", nil, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *StorageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.channels
+	ch <- c.events
+}
+
+// Collect implements prometheus.Collector
+func (c *StorageCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.storage.Stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.channels, err)
+		ch <- prometheus.NewInvalidMetric(c.events, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.channels, prometheus.GaugeValue, float64(stats.Channels))
+	ch <- prometheus.MustNewConstMetric(c.events, prometheus.GaugeValue, float64(stats.Events))
+}
+
+// channelPrefix returns label for per-channel metrics, it's the longest of the configured prefixes
+// the channel id starts with, e.g. "user_" for "user_42", or "other".
+// Channel ids are chosen by publishers, so they aren't used as labels to keep cardinality bounded.
+func channelPrefix(channelID string) string {
+	label := otherChannelsLabel
+	matched := 0
+	for _, prefix := range metricsChannelPrefixes {
+		if len(prefix) > matched && strings.HasPrefix(channelID, prefix) {
+			label, matched = prefix, len(prefix)
+		}
+	}
+	return label
+}
+
+// trackConnection counts subscriber connection by route, returns func to be called on disconnect
+func trackConnection(r *http.Request) func() {
+	route := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+	g := connectionsGauge.WithLabelValues(route)
+	g.Inc()
+	return g.Dec
+}
+
+// collectGarbage runs garbage collector of storage and records its duration and number of removed events
+func collectGarbage(gc func(maxAge time.Duration, active ActiveConsumers) (int, error), maxAge time.Duration, active ActiveConsumers) error {
+	start := time.Now()
+	removed, err := gc(maxAge, active)
+	gcDuration.Observe(time.Since(start).Seconds())
+	gcEvictedCounter.Add(float64(removed))
+	return err
+}
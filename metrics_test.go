@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestChannelPrefix(t *testing.T) {
+	defer func(prefixes []string) { metricsChannelPrefixes = prefixes }(metricsChannelPrefixes)
+	metricsChannelPrefixes = []string{"user_", "user_admin_", "news"}
+
+	tests := []struct {
+		channelID string
+		want      string
+	}{
+		{"user_42", "user_"},
+		{"user_admin_1", "user_admin_"},
+		{"news", "news"},
+		{"news_sport", "news"},
+		// ids chosen by publishers don't become labels
+		{"5f0c6a2e-9d1b-4c1e-8f5a-3c2d1e0f9a8b", otherChannelsLabel},
+		{"user", otherChannelsLabel},
+		{"", otherChannelsLabel},
+	}
+	for _, tt := range tests {
+		if got := channelPrefix(tt.channelID); got != tt.want {
+			t.Errorf("channelPrefix(%q) = %q, want %q", tt.channelID, got, tt.want)
+		}
+	}
+
+	metricsChannelPrefixes = nil
+	if got := channelPrefix("user_42"); got != otherChannelsLabel {
+		t.Errorf("without configured prefixes channelPrefix() = %q, want %q", got, otherChannelsLabel)
+	}
+}
@@ -1,34 +1,364 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/cors"
+	"github.com/go-chi/jwtauth"
+)
+
+// Headers of signed requests
+const (
+	SignatureKeyHeader       = "X-Signature-Key"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureHeader          = "X-Signature"
+)
+
+const (
+	defaultSignatureWindow = 5 * time.Minute
+	// maximum size of body of signed request
+	maxSignedBodySize = maxBatchBodySize
 )
 
+type (
+	// SignatureVerifier verifies requests signed by publishers:
+	// X-Signature is hex encoded HMAC-SHA256 of "METHOD\nPATH\nTIMESTAMP\nBODY"
+	// computed with secret of the api key named by X-Signature-Key,
+	// X-Signature-Timestamp is unix time in seconds.
+	SignatureVerifier struct {
+		keys *KeyStore
+		// maximum difference between the request timestamp and the server time
+		window time.Duration
+		// reject requests which aren't signed
+		required bool
+		replays  ReplayCache
+	}
+
+	// ReplayCache remembers signatures of accepted requests until they expire
+	ReplayCache interface {
+		// Remember stores signature until expiration time, returns false if it has been already seen
+		Remember(signature string, expiresAt, now time.Time) (bool, error)
+	}
+
+	// memoryReplayCache keeps signatures seen by this instance of the server, by expiration time
+	memoryReplayCache struct {
+		sync.Mutex
+		seen map[string]time.Time
+		// expired signatures are swept not more often than once per the window
+		window    time.Duration
+		lastSweep time.Time
+	}
+)
+
+// NewSignatureVerifier is a factory func, returns a new instance of the SignatureVerifier structure
+func NewSignatureVerifier(keys *KeyStore, window time.Duration, required bool) *SignatureVerifier {
+	if window <= 0 {
+		window = defaultSignatureWindow
+	}
+	return &SignatureVerifier{
+		keys:     keys,
+		window:   window,
+		required: required,
+		replays:  &memoryReplayCache{seen: make(map[string]time.Time), window: window},
+	}
+}
+
+// SetReplayCache replaces the cache of signatures seen by this instance,
+// e.g. with the one shared by all instances of the server
+func (v *SignatureVerifier) SetReplayCache(replays ReplayCache) {
+	if v != nil {
+		v.replays = replays
+	}
+}
+
+// ShareReplays makes the verifier remember signatures together with the previous one,
+// so requests accepted before configuration has been reloaded can't be replayed after that
+func (v *SignatureVerifier) ShareReplays(prev *SignatureVerifier) {
+	if v != nil && prev != nil {
+		v.replays = prev.replays
+	}
+}
+
+// Verify returns middleware which authenticates signed requests and stores api key in the request context.
+// Unsigned requests are passed through to be authenticated by api key, unless signature is required.
+func (v *SignatureVerifier) Verify(next http.Handler) http.Handler {
+	if v == nil || v.keys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(SignatureHeader) == "" {
+			if v.required {
+				http.Error(w, "Signature required", 401)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		ts, err := strconv.ParseInt(r.Header.Get(SignatureTimestampHeader), 10, 64)
+		if err != nil {
+			http.Error(w, "Wrong signature timestamp", 401)
+			return
+		}
+		if d := now.Sub(time.Unix(ts, 0)); d > v.window || d < -v.window {
+			http.Error(w, "Signature expired", 401)
+			return
+		}
+		signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+		if err != nil {
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		message := signedMessage(r.Method, r.URL.EscapedPath(), r.Header.Get(SignatureTimestampHeader), body)
+		key := v.keys.AuthenticateSignature(r.Header.Get(SignatureKeyHeader), message, signature, now)
+		if key == nil {
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
+		// the same signed request can't be sent twice while its timestamp is within the window
+		ok, err := v.replays.Remember(string(signature), time.Unix(ts, 0).Add(v.window), now)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Replayed request", 401)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), key)))
+	})
+}
+
+// Remember stores signature until expiration time, returns false if it has been already seen
+func (c *memoryReplayCache) Remember(signature string, expiresAt, now time.Time) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.lastSweep) > c.window {
+		for sig, t := range c.seen {
+			if now.After(t) {
+				delete(c.seen, sig)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, ok := c.seen[signature]; ok {
+		return false, nil
+	}
+	c.seen[signature] = expiresAt
+	return true, nil
+}
+
+// signedMessage returns the string which is signed by publisher
+func signedMessage(method, path, timestamp string, body []byte) []byte {
+	b := make([]byte, 0, len(method)+len(path)+len(timestamp)+len(body)+3)
+	b = append(b, method...)
+	b = append(b, '\n')
+	b = append(b, path...)
+	b = append(b, '\n')
+	b = append(b, timestamp...)
+	b = append(b, '\n')
+	return append(b, body...)
+}
+
+// requestLogger logs every request when it's completed,
+// query string isn't logged, because it may contain tokens
+func requestLogger(log Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			defer func() {
+				log.With(Fields{
+					"event":       "http_request",
+					"request_id":  middleware.GetReqID(r.Context()),
+					"method":      r.Method,
+					"path":        r.URL.Path,
+					"status":      ww.Status(),
+					"bytes":       ww.BytesWritten(),
+					"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+					"remote_addr": r.RemoteAddr,
+				}).Infof("%s %s", r.Method, r.URL.Path)
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+// CORS is a cors middleware which allowed origins can be replaced at runtime
+type CORS struct {
+	cors    atomic.Value
+	origins atomic.Value
+}
+
+// NewCORS is a factory func, returns a new instance of the CORS structure
+func NewCORS(allowedOrigins []string) *CORS {
+	c := &CORS{}
+	c.SetAllowedOrigins(allowedOrigins)
+	return c
+}
+
+// SetAllowedOrigins replaces list of allowed origins
+func (c *CORS) SetAllowedOrigins(allowedOrigins []string) {
+	origins := make([]string, 0, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		origins = append(origins, strings.ToLower(o))
+	}
+	c.origins.Store(origins)
+	c.cors.Store(cors.New(cors.Options{
+		// the same check is used for websocket connections, see OriginAllowed
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			return matchOrigin(origins, origin)
+		},
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID", "Origin", SignatureKeyHeader, SignatureTimestampHeader, SignatureHeader},
+		AllowCredentials: true,
+		MaxAge:           10080, // Maximum value not ignored by any of major browsers
+	}))
+}
+
+// Handler applies the current cors settings to the request
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.cors.Load().(*cors.Cors).Handler(next).ServeHTTP(w, r)
+	})
+}
+
+// OriginAllowed reports whether the request comes from allowed origin,
+// requests without origin aren't sent by browsers, so they are allowed
+func (c *CORS) OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || matchOrigin(c.origins.Load().([]string), origin)
+}
+
+// matchOrigin reports whether origin matches any of lower case patterns,
+// "*" matches any origin, a pattern may contain one wildcard, e.g.: "https://*.example.com"
+func matchOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, p := range patterns {
+		if p == "*" || p == origin {
+			return true
+		}
+		if i := strings.IndexByte(p, '*'); i >= 0 {
+			prefix, suffix := p[:i], p[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passThrough is a middleware which does nothing
+func passThrough(next http.Handler) http.Handler {
+	return next
+}
+
 func tokenFromQuery(r *http.Request) string {
 	return r.URL.Query().Get("token")
 }
 
-func basicToken(t string) func(next http.Handler) http.Handler {
+// authorizeChannels rejects request if jwt doesn't grant access to channels from the url parameter,
+// the parameter may contain comma separated list of channels,
+// or if at-least-once consumer from the query string doesn't belong to the subject
+func authorizeChannels(verifier *JWTVerifier, param string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		if verifier == nil {
+			return next
+		}
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token := r.URL.Query().Get("token")
-			if token == "" {
+			_, claims, err := jwtauth.FromContext(r.Context())
+			if err != nil {
 				http.Error(w, http.StatusText(401), 401)
 				return
 			}
-			if token != t {
-				http.Error(w, http.StatusText(401), 401)
+			patterns := grantedChannels(claims, verifier.channelTemplate)
+			for _, channelID := range strings.Split(chi.URLParam(r, param), ",") {
+				if !matchChannel(patterns, channelID) {
+					http.Error(w, http.StatusText(403), 403)
+					return
+				}
+			}
+			if consumerID := r.URL.Query().Get("consumer"); consumerID != "" && !consumerOfSubject(claims, consumerID) {
+				http.Error(w, http.StatusText(403), 403)
 				return
 			}
-			// Token is authenticated, pass it through
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// grantedChannels returns channel patterns granted by jwt claims:
+// glob patterns from the "channels" claim (list or comma separated string)
+// and patterns built from the template by substitution of the "sub" claim for {sub},
+// e.g.: "user_notifications_{sub},news_*"
+func grantedChannels(claims jwtauth.Claims, template string) []string {
+	var patterns []string
+	switch v := claims["channels"].(type) {
+	case string:
+		patterns = append(patterns, strings.Split(v, ",")...)
+	case []interface{}:
+		for _, p := range v {
+			if s, ok := p.(string); ok {
+				patterns = append(patterns, s)
+			}
+		}
+	}
+	if sub, ok := claims["sub"].(string); ok && sub != "" && template != "" {
+		// subject must not be able to widen the pattern
+		sub = globEscaper.Replace(sub)
+		for _, t := range strings.Split(template, ",") {
+			patterns = append(patterns, strings.Replace(t, "{sub}", sub, -1))
+		}
+	}
+	return patterns
+}
+
+// consumerOfSubject reports whether at-least-once consumer belongs to the "sub" claim of jwt,
+// so a subscriber can't acknowledge events on behalf of another one:
+// consumer id is the subject itself or the subject followed by a dot and a suffix, e.g.: "user42.phone"
+func consumerOfSubject(claims jwtauth.Claims, consumerID string) bool {
+	sub, ok := claims["sub"].(string)
+	if !ok || sub == "" {
+		return false
+	}
+	return consumerID == sub || strings.HasPrefix(consumerID, sub+".")
+}
+
+// matchChannel reports whether channel id matches any of glob patterns, case insensitive
+func matchChannel(patterns []string, channelID string) bool {
+	channelID = strings.ToLower(channelID)
+	for _, p := range patterns {
+		if ok, err := path.Match(strings.ToLower(strings.TrimSpace(p)), channelID); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
 func basicAuth(user, password string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+// signHS256 returns token with given claims signed with the secret, which expires in a minute
+func signHS256(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGrantedChannels(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		template string
+		want     []string
+	}{
+		{"no claims", map[string]interface{}{}, "", nil},
+		{"list", map[string]interface{}{"channels": []interface{}{"news_*", "chat", 42}}, "", []string{"news_*", "chat"}},
+		{"comma separated string", map[string]interface{}{"channels": "news_*,chat"}, "", []string{"news_*", "chat"}},
+		{"template", map[string]interface{}{"sub": "alice"}, "user_{sub},inbox_{sub}_*", []string{"user_alice", "inbox_alice_*"}},
+		{"template without subject", map[string]interface{}{"channels": "chat"}, "user_{sub}", []string{"chat"}},
+		{"channels and template", map[string]interface{}{"sub": "alice", "channels": []interface{}{"chat"}}, "user_{sub}", []string{"chat", "user_alice"}},
+		{"subject with glob characters", map[string]interface{}{"sub": `a*[b]?\`}, "user_{sub}", []string{`user_a\*\[b]\?\\`}},
+	}
+	for _, tt := range tests {
+		got := grantedChannels(tt.claims, tt.template)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchChannel(t *testing.T) {
+	patterns := []string{"news_*", " Chat ", `user_a\*`}
+	tests := []struct {
+		channelID string
+		want      bool
+	}{
+		{"news_sport", true},
+		{"NEWS_sport", true},
+		{"chat", true},
+		{"chat2", false},
+		{`user_a*`, true},
+		{"user_alice", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := matchChannel(patterns, tt.channelID); got != tt.want {
+			t.Errorf("matchChannel(%q) = %v, want %v", tt.channelID, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeChannels(t *testing.T) {
+	v, err := NewJWTVerifierFromConfig(JWTConfig{Secret: "secret", ChannelTemplate: "user_{sub}"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Use(v.Verify(tokenFromQuery))
+	r.With(authorizeChannels(v, "channels")).Get("/{channels}", func(w http.ResponseWriter, r *http.Request) {})
+
+	alice := signHS256(t, "secret", jwt.MapClaims{"sub": "alice", "channels": "news_*"})
+	wildcard := signHS256(t, "secret", jwt.MapClaims{"sub": "*"})
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{"channel of the subject", "/user_alice?token=" + alice, http.StatusOK},
+		{"granted channel", "/news_sport?token=" + alice, http.StatusOK},
+		{"all channels of the list are granted", "/user_alice,news_sport?token=" + alice, http.StatusOK},
+		{"a channel of the list isn't granted", "/user_alice,user_bob?token=" + alice, http.StatusForbidden},
+		{"channel of another subject", "/user_bob?token=" + alice, http.StatusForbidden},
+		{"subject doesn't widen the template", "/user_bob?token=" + wildcard, http.StatusForbidden},
+		{"own consumer", "/user_alice?consumer=alice.phone&token=" + alice, http.StatusOK},
+		{"consumer of another subject", "/user_alice?consumer=bob&token=" + alice, http.StatusForbidden},
+		{"without token", "/user_alice", http.StatusUnauthorized},
+		{"wrong token", "/user_alice?token=" + signHS256(t, "wrong", jwt.MapClaims{"sub": "alice"}), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+	}
+
+	// channels are not checked if jwt authentication is disabled
+	w := httptest.NewRecorder()
+	authorizeChannels(nil, "channels")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user_bob", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("disabled jwt: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSubscriptionRoutesAuthorizeChannels(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	auth, err := NewAuth(AuthConfig{JWT: JWTConfig{Secret: "secret", ChannelTemplate: "user_{sub}"}}, h.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuth(auth)
+	router := h.Router()
+	token := signHS256(t, "secret", jwt.MapClaims{"sub": "alice"})
+	// subscriptions are streamed until the client goes away, so the client is gone already
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, route := range []string{"/listen/single/", "/listen/multi/", "/sub/", "/multisub-split/", "/poll/", "/history/"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route+"user_bob?token="+token, nil).WithContext(ctx))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s of another subject: status %d, want %d", route, w.Code, http.StatusForbidden)
+		}
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route+"user_bob", nil).WithContext(ctx))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without token: status %d, want %d", route, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	for _, url := range []string{"/listen/single/user_alice", "/listen/multi/user_alice,User_Alice"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url+"?token="+token, nil).WithContext(ctx))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			t.Errorf("%s: status %d, content type %q", url, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
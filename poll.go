@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 120 * time.Second
+)
+
+// PollResponse struct
+type PollResponse struct {
+	Events      []JSONEvent `json:"events"`
+	LastEventID string      `json:"last_event_id"`
+}
+
+// pollChannels returns events newer than the last_event_id cursor,
+// if there are no such events, it holds the request until the next event or timeout
+func (h *Handler) pollChannels(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
+	channelsStr := chi.URLParam(r, "channels")
+	if channelsStr == "" {
+		log.Debugf("missed channel id")
+		http.Error(w, "Missed channel id!", http.StatusBadRequest)
+		return
+	}
+	channels := strings.Split(channelsStr, ",")
+	log = log.With(Fields{"channel": channelsStr})
+
+	timeout := defaultPollTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			http.Error(w, "Wrong timeout, expected number of seconds", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(sec) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	replay, err := getReplay(r)
+	if err != nil {
+		log.Debugf("wrong history replay: %v", err)
+		http.Error(w, fmt.Sprintf("Wrong history replay: %v", err), http.StatusBadRequest)
+		return
+	}
+	lastEventID := replay.LastEventID
+
+	// subscribe before reading history, so events published in between are not lost
+	listener, history, err := h.sse.SubscribeToMultiChannel(channels, replay)
+	if err != nil {
+		log.Errorf("poll channels %s with last event id %s: %v", channelsStr, lastEventID, err)
+		http.Error(w, "Could not subscribe to events channel", http.StatusInternalServerError)
+		return
+	}
+	defer h.sse.UnsubscribeFromMultiChannel(channels, listener)
+	defer trackConnection(r)()
+
+	resp := PollResponse{
+		Events:      make([]JSONEvent, 0, len(history)),
+		LastEventID: lastEventID,
+	}
+	add := func(event Event) {
+		if event.IsExpired() {
+			return
+		}
+		se := event.MapToSseEvent()
+		resp.Events = append(resp.Events, mapSseEventToJSON(se))
+		if se.Id != "" {
+			resp.LastEventID = se.Id
+		}
+	}
+
+	for _, event := range history {
+		add(event)
+	}
+
+	if len(resp.Events) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				log.With(Fields{"event": "poll_client_disconnected"}).Debugf("client closed connection: %s", channelsStr)
+				return
+			case <-timer.C:
+				break wait
+			case <-h.sse.Done():
+				// respond with no events, the client polls again and gets to another instance
+				break wait
+			case event := <-listener.Events():
+				if e, ok := event.(Event); ok {
+					add(e)
+				}
+				if len(resp.Events) == 0 {
+					continue
+				}
+				// take events which have been queued at the same time
+				for {
+					select {
+					case event := <-listener.Events():
+						if e, ok := event.(Event); ok {
+							add(e)
+						}
+					default:
+						break wait
+					}
+				}
+			}
+		}
+	}
+
+	log.With(Fields{"event": "poll_received_events", "event_id": resp.LastEventID}).Debugf("channels %s: received %d events", channelsStr, len(resp.Events))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("encode poll response: %v (channels: %s)", err, channelsStr)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPollResumesAcrossChannels(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+
+	publish(t, sse, "a", "a1")
+	publish(t, sse, "b", "b1")
+
+	resp := PollResponse{}
+	if w := getJSON(t, router, http.MethodGet, "/poll/a,b?last_event_id=0", &resp); w.Code != http.StatusOK {
+		t.Fatalf("poll: status %d, %s", w.Code, w.Body.String())
+	}
+	if len(resp.Events) != 2 {
+		t.Fatalf("poll: got %d events, want 2", len(resp.Events))
+	}
+
+	// the cursor is id of the event of channel b, it isn't stored in channel a
+	publish(t, sse, "a", "a2")
+	publish(t, sse, "b", "b2")
+
+	cursor := resp.LastEventID
+	resp = PollResponse{}
+	if w := getJSON(t, router, http.MethodGet, "/poll/a,b?timeout=0&last_event_id="+cursor, &resp); w.Code != http.StatusOK {
+		t.Fatalf("poll: status %d, %s", w.Code, w.Body.String())
+	}
+	var titles []string
+	for _, e := range resp.Events {
+		titles = append(titles, e.Data.(map[string]interface{})["title"].(string))
+	}
+	if len(titles) != 2 || titles[0] != "a2" || titles[1] != "b2" {
+		t.Errorf("poll after %s: got %v, want [a2 b2]", cursor, titles)
+	}
+}
+
+func TestPollWrongCursor(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	router := h.Router()
+
+	// cursors are validated once by the handler, so every storage gets a valid one
+	for _, cursor := range []string{"x", "-1", "-1:0", "9223372036854775807"} {
+		if w := getJSON(t, router, http.MethodGet, "/poll/a,b?timeout=0&last_event_id="+cursor, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("last event id %s: status %d, want %d", cursor, w.Code, http.StatusBadRequest)
+		}
+	}
+}
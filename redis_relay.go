@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/go-redis/redis"
+)
+
+type (
+	// RedisRelay struct, fans out published events to all instances of the server via redis pub/sub
+	RedisRelay struct {
+		client *redis.Client
+		hub    *Hub
+		topic  string
+		pubsub *redis.PubSub
+	}
+
+	relayMessage struct {
+		Channel string          `json:"channel"`
+		Event   json.RawMessage `json:"event"`
+	}
+)
+
+// NewRedisRelay is a factory func, returns a new instance of the RedisRelay structure
+func NewRedisRelay(client *redis.Client, prefix string, hub *Hub) *RedisRelay {
+	topic := prefix + "relay"
+	return &RedisRelay{
+		client: client,
+		hub:    hub,
+		topic:  topic,
+		pubsub: client.Subscribe(topic),
+	}
+}
+
+// Publish event to all instances of the server
+func (r *RedisRelay) Publish(channelID string, event Event) error {
+	e, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(relayMessage{
+		Channel: channelID,
+		Event:   e,
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(r.topic, msg).Err()
+}
+
+// Run receives events published by any instance and submits them to the local hub,
+// it blocks until the relay is closed
+func (r *RedisRelay) Run(log Logger) error {
+	if _, err := r.pubsub.Receive(); err != nil {
+		return err
+	}
+
+	for m := range r.pubsub.Channel() {
+		msg := relayMessage{}
+		if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+			log.Errorf("relay: decode message: %v", err)
+			continue
+		}
+		event, err := decodeEvent(msg.Event)
+		if err != nil {
+			log.Errorf("relay: decode event: %v", err)
+			continue
+		}
+		r.hub.Submit(msg.Channel, event)
+	}
+
+	return nil
+}
+
+// Close stops receiving of events
+func (r *RedisRelay) Close() error {
+	return r.pubsub.Close()
+}
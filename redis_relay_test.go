@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedisRelayFanOut(t *testing.T) {
+	_, client, stop := newTestRedis(t)
+	defer stop()
+	log, err := NewLogger(testWriter{t}, "text", ErrorLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two instances of the server share the redis
+	hubs := []*Hub{NewHub(8, Disconnect), NewHub(8, Disconnect)}
+	relays := make([]*RedisRelay, len(hubs))
+	subs := make([]*Subscriber, len(hubs))
+	for i, hub := range hubs {
+		relays[i] = NewRedisRelay(client, "test:", hub)
+		defer relays[i].Close()
+		go relays[i].Run(log)
+		subs[i] = hub.Open("news")
+	}
+	other := hubs[1].Open("other")
+
+	// wait for subscriptions, messages published before them are lost
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, err := client.PubSubNumSub("test:relay").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n["test:relay"] == int64(len(relays)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relays haven't subscribed: %v", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := relays[0].Publish("News", Event{ID: 42, Type: "alert", Data: EventData{Title: "hello"}, TTL: 60, Timestamp: 41}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sub := range subs {
+		select {
+		case e := <-sub.Events():
+			event, ok := e.(Event)
+			if !ok {
+				t.Fatalf("hub %d: got %T, want Event", i, e)
+			}
+			want := Event{ID: 42, Type: "alert", Data: EventData{Title: "hello"}, TTL: 60, Timestamp: 41}
+			if event.ID != want.ID || event.Type != want.Type || event.Data.Title != want.Data.Title ||
+				event.TTL != want.TTL || event.Timestamp != want.Timestamp {
+				t.Errorf("hub %d: got %+v, want %+v", i, event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("hub %d hasn't received the event", i)
+		}
+	}
+	select {
+	case e := <-other.Events():
+		t.Errorf("subscriber of another channel has received %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testWriter writes log of the server to the test log
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
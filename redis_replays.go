@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisReplayCache struct, keeps signatures of accepted requests in redis,
+// so a request accepted by one instance of the server can't be replayed to another one
+type RedisReplayCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisReplayCache is a factory func, returns a new instance of the RedisReplayCache structure
+func NewRedisReplayCache(client *redis.Client, prefix string) *RedisReplayCache {
+	return &RedisReplayCache{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Remember stores signature until expiration time, returns false if it has been already seen
+func (c *RedisReplayCache) Remember(signature string, expiresAt, now time.Time) (bool, error) {
+	ttl := expiresAt.Sub(now)
+	// zero ttl means the key never expires
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return c.client.SetNX(c.prefix+"signature:"+hex.EncodeToString([]byte(signature)), 1, ttl).Result()
+}
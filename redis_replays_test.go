@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedisReplayCache(t *testing.T) {
+	mr, client, stop := newTestRedis(t)
+	defer stop()
+	c := NewRedisReplayCache(client, "test:")
+	now := time.Now()
+
+	if ok, err := c.Remember("signature", now.Add(time.Minute), now); err != nil || !ok {
+		t.Fatalf("new signature: %v, %v", ok, err)
+	}
+	if ok, err := c.Remember("signature", now.Add(time.Minute), now); err != nil || ok {
+		t.Fatalf("seen signature: %v, %v", ok, err)
+	}
+	if ok, err := c.Remember("another", now.Add(time.Minute), now); err != nil || !ok {
+		t.Fatalf("another signature: %v, %v", ok, err)
+	}
+	// signature is kept within the window only
+	keys := mr.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("keys %v, want 2", keys)
+	}
+	if ttl := mr.TTL(keys[0]); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("ttl of %s = %v", keys[0], ttl)
+	}
+	mr.FastForward(time.Minute + time.Second)
+	if ok, err := c.Remember("signature", now.Add(time.Minute), now); err != nil || !ok {
+		t.Errorf("expired signature: %v, %v", ok, err)
+	}
+}
+
+func TestSignedRequestReplayedToAnotherInstance(t *testing.T) {
+	mr, client, stop := newTestRedis(t)
+	defer stop()
+
+	// instances of the server share signatures in redis
+	var routers []http.Handler
+	for i := 0; i < 2; i++ {
+		h, _ := newTestHandler(t, NewMemStorage())
+		auth, err := NewAuth(AuthConfig{BasicToken: "secret", SignatureWindow: Duration(defaultSignatureWindow)}, h.log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth.Signatures.SetReplayCache(NewRedisReplayCache(client, "test:"))
+		h.SetAuth(auth)
+		routers = append(routers, h.Router())
+	}
+
+	body := []byte(`{"title":"signed"}`)
+	now := time.Now()
+	tests := []struct {
+		name     string
+		router   http.Handler
+		r        *http.Request
+		wantCode int
+	}{
+		{"signed", routers[0], signedRequest("secret", "/pub/ch", body, now), http.StatusOK},
+		{"replayed to another instance", routers[1], signedRequest("secret", "/pub/ch", body, now), http.StatusUnauthorized},
+		{"replayed to the same instance", routers[0], signedRequest("secret", "/pub/ch", body, now), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.router.ServeHTTP(w, tt.r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+
+	// request isn't accepted if it can't be checked for replay
+	mr.Close()
+	w := httptest.NewRecorder()
+	routers[1].ServeHTTP(w, signedRequest("secret", "/pub/ch", []byte(`{"title":"redis is down"}`), now))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("redis is down: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
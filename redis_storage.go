@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// number of attempts of optimistic transaction before giving up
+const redisMaxTxRetries = 100
+
+// maximum delay before the next attempt of optimistic transaction
+const redisMaxTxBackoff = time.Millisecond
+
+// field of the acknowledgements hash with the id the consumer is registered with
+const redisAckFromField = "from"
+
+// RedisStorage struct, keeps events in redis so history is shared between all instances of the server.
+// Every channel is stored in its own sorted set, all members have the same score
+// and are prefixed with zero padded event id, so lexicographical order of members
+// is the same as order of event ids and it isn't affected by float precision of scores.
+// Inbox states of a channel are kept in a hash keyed by event id.
+// Acknowledgements of a consumer are kept in a hash of acknowledged event ids,
+// with the id the consumer is registered with in the "from" field.
+// Channels with registered consumers are kept in a set, so gc finds them when they have no events.
+type RedisStorage struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStorage is a factory func, returns a new instance of the RedisStorage structure
+func NewRedisStorage(client *redis.Client, prefix string) *RedisStorage {
+	return &RedisStorage{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// NewRedisClient connects to redis server by given url, e.g.: redis://:password@localhost:6379/0
+func NewRedisClient(redisURL string) (*redis.Client, error) {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opt)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close does nothing, every write is sent to redis immediately
+// and the client is closed by its owner, as it's shared with the relay
+func (s *RedisStorage) Close() error {
+	return nil
+}
+
+// GetAllInChannel returns all events in channel
+func (s *RedisStorage) GetAllInChannel(channelID string) []Event {
+	members, err := s.client.ZRange(s.eventsKey(channelID), 0, -1).Result()
+	if err != nil {
+		return nil
+	}
+	return decodeRedisMembers(members)
+}
+
+// GetByLastID returns events in a channel which has id greater than given one
+func (s *RedisStorage) GetByLastID(channelID string, lastEventID int64) []Event {
+	members, err := s.client.ZRangeByLex(s.eventsKey(channelID), redis.ZRangeBy{
+		Min: "[" + redisMemberPrefix(lastEventID+1),
+		Max: "+",
+	}).Result()
+	if err != nil {
+		return nil
+	}
+	return decodeRedisMembers(members)
+}
+
+// GetLast returns the most recent events in a channel, up to given number
+func (s *RedisStorage) GetLast(channelID string, n int) ([]Event, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	members, err := s.client.ZRange(s.eventsKey(channelID), int64(-n), -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisMembers(members), nil
+}
+
+// GetSince returns events in a channel which have been published at or after given time
+func (s *RedisStorage) GetSince(channelID string, since time.Time) ([]Event, error) {
+	t := since.UnixNano()
+	members, err := s.client.ZRangeByLex(s.eventsKey(channelID), redis.ZRangeBy{
+		Min: "[" + redisMemberPrefix(t),
+		Max: "+",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return publishedSince(decodeRedisMembers(members), t), nil
+}
+
+// GetPage returns page of events in a channel
+func (s *RedisStorage) GetPage(channelID string, query PageQuery) ([]Event, error) {
+	if query.Limit <= 0 {
+		return nil, nil
+	}
+	by := redis.ZRangeBy{
+		Min:   "[" + redisMemberPrefix(query.AfterID+1),
+		Max:   "+",
+		Count: int64(query.Limit),
+	}
+	if query.BeforeID > 0 {
+		by.Max = "(" + redisMemberPrefix(query.BeforeID)
+	}
+
+	var members []string
+	var err error
+	if query.Descending {
+		members, err = s.client.ZRevRangeByLex(s.eventsKey(channelID), by).Result()
+	} else {
+		members, err = s.client.ZRangeByLex(s.eventsKey(channelID), by).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisMembers(members), nil
+}
+
+// NextID returns the next id of event in a channel, the sequence is shared by all channels
+// and all instances of the server, so ids are increasing even if clocks of instances differ
+func (s *RedisStorage) NextID(channelID string, now int64) (int64, error) {
+	key := s.lastIDKey()
+	var id int64
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err := s.client.Watch(func(tx *redis.Tx) error {
+			lastID, err := tx.Get(key).Int64()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			id = nextEventID(lastID, now)
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key, id, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return id, err
+		}
+		// concurrent publishers back off for a random time, so they don't collide again
+		time.Sleep(time.Duration(rand.Int63n(int64(redisMaxTxBackoff))))
+	}
+	return 0, fmt.Errorf("too many concurrent updates of the last id, channel %s", channelID)
+}
+
+// Add event to storage
+func (s *RedisStorage) Add(channelID string, event Event) error {
+	b, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(s.eventsKey(channelID), redis.Z{Member: redisMemberPrefix(event.ID) + ":" + string(b)})
+		pipe.SAdd(s.channelsKey(), channelID)
+		return nil
+	})
+	return err
+}
+
+// Delete event from storage
+func (s *RedisStorage) Delete(channelID string, event Event) error {
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByLex(
+			s.eventsKey(channelID),
+			"["+redisMemberPrefix(event.ID),
+			"("+redisMemberPrefix(event.ID+1),
+		)
+		pipe.HDel(s.inboxKey(channelID), formatEventID(event.ID))
+		return nil
+	})
+	return err
+}
+
+// SetInboxState sets state of events in a channel, unread state isn't stored
+func (s *RedisStorage) SetInboxState(channelID string, ids []int64, state InboxState) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	key := s.inboxKey(channelID)
+	if state == InboxUnread {
+		fields := make([]string, 0, len(ids))
+		for _, id := range ids {
+			fields = append(fields, formatEventID(id))
+		}
+		return s.client.HDel(key, fields...).Err()
+	}
+	fields := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		fields[formatEventID(id)] = string(state)
+	}
+	return s.client.HMSet(key, fields).Err()
+}
+
+// GetInboxStates returns states of events in a channel which aren't unread
+func (s *RedisStorage) GetInboxStates(channelID string) (map[int64]InboxState, error) {
+	fields, err := s.client.HGetAll(s.inboxKey(channelID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]InboxState, len(fields))
+	for k, v := range fields {
+		if id, err := strconv.ParseInt(k, 10, 64); err == nil {
+			res[id] = InboxState(v)
+		}
+	}
+	return res, nil
+}
+
+// RegisterConsumer starts tracking of acknowledgements of the consumer in a channel
+func (s *RedisStorage) RegisterConsumer(channelID, consumerID string, from int64) (int64, error) {
+	var registered *redis.StringCmd
+	key := s.acksKey(channelID, consumerID)
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(key, redisAckFromField, from)
+		pipe.SAdd(s.consumersKey(channelID), consumerID)
+		pipe.SAdd(s.consumerChannelsKey(), channelID)
+		registered = pipe.HGet(key, redisAckFromField)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return registered.Int64()
+}
+
+// Ack records acknowledgements of events by the consumer registered in the channel,
+// watch prevents race with gc which forgets the consumer
+func (s *RedisStorage) Ack(channelID, consumerID string, ids []int64) error {
+	key := s.acksKey(channelID, consumerID)
+	fields := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		fields[formatEventID(id)] = 1
+	}
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err := s.client.Watch(func(tx *redis.Tx) error {
+			registered, err := tx.HExists(key, redisAckFromField).Result()
+			if err != nil {
+				return err
+			}
+			if !registered {
+				return ErrConsumerNotRegistered
+			}
+			if len(fields) == 0 {
+				return nil
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.HMSet(key, fields)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(redisMaxTxBackoff))))
+	}
+	return fmt.Errorf("too many concurrent updates of consumer %s in channel %s", consumerID, channelID)
+}
+
+// GetAckState returns acknowledgements of the consumer in a channel
+func (s *RedisStorage) GetAckState(channelID, consumerID string) (AckState, error) {
+	res := AckState{Acked: make(map[int64]bool)}
+	fields, err := s.client.HGetAll(s.acksKey(channelID, consumerID)).Result()
+	if err != nil {
+		return res, err
+	}
+	for k, v := range fields {
+		if k == redisAckFromField {
+			res.From, _ = strconv.ParseInt(v, 10, 64)
+		} else if id, err := strconv.ParseInt(k, 10, 64); err == nil {
+			res.Acked[id] = true
+		}
+	}
+	return res, nil
+}
+
+// GC - garbage collector, it runs until stop is closed
+func (s *RedisStorage) GC(maxAge, period time.Duration, active ActiveConsumers, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			collectGarbage(s.gc, maxAge, active)
+		}
+	}
+}
+
+// Stats returns number of channels and events in storage
+func (s *RedisStorage) Stats() (StorageStats, error) {
+	channels, err := s.client.SMembers(s.channelsKey()).Result()
+	if err != nil {
+		return StorageStats{}, err
+	}
+	stats := StorageStats{Channels: len(channels)}
+	cmds, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, channelID := range channels {
+			pipe.ZCard(s.eventsKey(channelID))
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	for _, cmd := range cmds {
+		stats.Events += int(cmd.(*redis.IntCmd).Val())
+	}
+	return stats, nil
+}
+
+// gc deletes expired events, returns number of deleted events
+func (s *RedisStorage) gc(maxAge time.Duration, active ActiveConsumers) (int, error) {
+	// consumers may be registered in channels without events
+	channels, err := s.client.SUnion(s.channelsKey(), s.consumerChannelsKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	t := time.Now().UnixNano() - maxAge.Nanoseconds()
+
+	removed := 0
+	for _, channelID := range channels {
+		key := s.eventsKey(channelID)
+		n, err := s.client.ZRemRangeByLex(key, "-", "("+redisMemberPrefix(t)).Result()
+		if err != nil {
+			return removed, err
+		}
+		removed += int(n)
+		if err := s.deleteInboxStatesBefore(channelID, t); err != nil {
+			return removed, err
+		}
+		// forget the channel if it's empty, watch prevents race with concurrent Add and RegisterConsumer
+		consumersKey := s.consumersKey(channelID)
+		err = s.client.Watch(func(tx *redis.Tx) error {
+			n, err := tx.ZCard(key).Result()
+			if err != nil || n > 0 {
+				return err
+			}
+			consumers, err := tx.SMembers(consumersKey).Result()
+			if err != nil {
+				return err
+			}
+			// consumers registered before max age are forgotten, there is nothing to redeliver to them
+			var forgotten []string
+			for _, consumerID := range consumers {
+				if active.has(channelID, consumerID) {
+					continue
+				}
+				from, err := tx.HGet(s.acksKey(channelID, consumerID), redisAckFromField).Int64()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				if from < t {
+					forgotten = append(forgotten, consumerID)
+				}
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.SRem(s.channelsKey(), channelID)
+				pipe.Del(s.inboxKey(channelID))
+				for _, consumerID := range forgotten {
+					pipe.Del(s.acksKey(channelID, consumerID))
+					pipe.SRem(consumersKey, consumerID)
+				}
+				if len(forgotten) == len(consumers) {
+					pipe.SRem(s.consumerChannelsKey(), channelID)
+				}
+				return nil
+			})
+			return err
+		}, key, consumersKey)
+		if err != nil && err != redis.TxFailedErr {
+			return removed, err
+		}
+		if err := s.pruneAcks(channelID, t, active); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// deleteInboxStatesBefore deletes states of events older than given time
+func (s *RedisStorage) deleteInboxStatesBefore(channelID string, t int64) error {
+	key := s.inboxKey(channelID)
+	ids, err := s.client.HKeys(key).Result()
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for _, k := range ids {
+		if id, err := strconv.ParseInt(k, 10, 64); err != nil || id < t {
+			expired = append(expired, k)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	return s.client.HDel(key, expired...).Err()
+}
+
+// pruneAcks deletes acknowledgements of events older than given time
+// and moves registration of consumers forward, as older events can't be redelivered,
+// active consumers are skipped
+func (s *RedisStorage) pruneAcks(channelID string, t int64, active ActiveConsumers) error {
+	consumers, err := s.client.SMembers(s.consumersKey(channelID)).Result()
+	if err != nil {
+		return err
+	}
+	for _, consumerID := range consumers {
+		if active.has(channelID, consumerID) {
+			continue
+		}
+		key := s.acksKey(channelID, consumerID)
+		state, err := s.GetAckState(channelID, consumerID)
+		if err != nil {
+			return err
+		}
+		pruned := AckState{From: state.From, Acked: make(map[int64]bool, len(state.Acked))}
+		for id := range state.Acked {
+			pruned.Acked[id] = true
+		}
+		pruneAckState(&pruned, t)
+
+		var expired []string
+		for id := range state.Acked {
+			if !pruned.Acked[id] {
+				expired = append(expired, formatEventID(id))
+			}
+		}
+		_, err = s.client.Pipelined(func(pipe redis.Pipeliner) error {
+			if len(expired) > 0 {
+				pipe.HDel(key, expired...)
+			}
+			if pruned.From != state.From {
+				pipe.HSet(key, redisAckFromField, pruned.From)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStorage) eventsKey(channelID string) string {
+	return s.prefix + "events:" + channelID
+}
+
+func (s *RedisStorage) lastIDKey() string {
+	return s.prefix + "last_id"
+}
+
+func (s *RedisStorage) inboxKey(channelID string) string {
+	return s.prefix + "inbox:" + channelID
+}
+
+// acksKey returns key of acknowledgements, consumer id doesn't contain colon, so keys are unambiguous
+func (s *RedisStorage) acksKey(channelID, consumerID string) string {
+	return s.prefix + "acks:" + channelID + ":" + consumerID
+}
+
+func (s *RedisStorage) consumersKey(channelID string) string {
+	return s.prefix + "consumers:" + channelID
+}
+
+func (s *RedisStorage) channelsKey() string {
+	return s.prefix + "channels"
+}
+
+func (s *RedisStorage) consumerChannelsKey() string {
+	return s.prefix + "consumer_channels"
+}
+
+// redisMemberPrefix returns zero padded event id, so members are sorted lexicographically by id
+func redisMemberPrefix(id int64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+func decodeRedisMembers(members []string) []Event {
+	events := make([]Event, 0, len(members))
+	for _, m := range members {
+		i := strings.IndexByte(m, ':')
+		if i < 0 {
+			continue
+		}
+		if event, err := decodeEvent([]byte(m[i+1:])); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
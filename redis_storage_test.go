@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// newTestRedis starts in-process redis server, returns client connected to it and func to stop both
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client, func()) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start redis: %v", err)
+	}
+	client, err := NewRedisClient("redis://" + mr.Addr())
+	if err != nil {
+		mr.Close()
+		t.Fatalf("connect to redis: %v", err)
+	}
+	return mr, client, func() {
+		client.Close()
+		mr.Close()
+	}
+}
+
+func TestRedisStorageNextIDConcurrent(t *testing.T) {
+	_, client, stop := newTestRedis(t)
+	defer stop()
+	s := NewRedisStorage(client, "test:")
+
+	const workers, perWorker = 8, 50
+	ids := make(chan int64, workers*perWorker)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last int64
+			for i := 0; i < perWorker; i++ {
+				id, err := s.NextID("ch", time.Now().UnixNano())
+				if err != nil {
+					errs <- err
+					return
+				}
+				if id <= last {
+					errs <- fmt.Errorf("id %d isn't greater than previous %d", id, last)
+					return
+				}
+				last = id
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int64]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d has been returned twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Fatalf("got %d ids, want %d", len(seen), workers*perWorker)
+	}
+}
+
+func TestRedisStorageRanges(t *testing.T) {
+	_, client, stop := newTestRedis(t)
+	defer stop()
+	s := NewRedisStorage(client, "test:")
+	must := mustEvents(t)
+
+	base := time.Now().Add(-time.Minute).UnixNano()
+	for _, id := range []int64{10, 20, 30, 40} {
+		if err := s.Add("ch", Event{ID: base + id, Timestamp: base + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		got  []Event
+		want []int64
+	}{
+		{"after stored id", s.GetByLastID("ch", base+20), []int64{30, 40}},
+		{"after id which isn't stored", s.GetByLastID("ch", base+15), []int64{20, 30, 40}},
+		{"after the last id", s.GetByLastID("ch", base+40), nil},
+		{"unknown channel", s.GetByLastID("nope", 0), nil},
+		{"page", must(s.GetPage("ch", PageQuery{AfterID: base + 10, Limit: 2})), []int64{20, 30}},
+		{"page before", must(s.GetPage("ch", PageQuery{BeforeID: base + 40, Limit: 10})), []int64{10, 20, 30}},
+		{"page descending", must(s.GetPage("ch", PageQuery{BeforeID: base + 40, Limit: 2, Descending: true})), []int64{30, 20}},
+		{"page between", must(s.GetPage("ch", PageQuery{AfterID: base + 10, BeforeID: base + 40, Limit: 10})), []int64{20, 30}},
+		{"empty page", must(s.GetPage("ch", PageQuery{AfterID: base + 10, Limit: 0})), nil},
+		{"since", must(s.GetSince("ch", time.Unix(0, base+25))), []int64{30, 40}},
+		{"since stored time", must(s.GetSince("ch", time.Unix(0, base+30))), []int64{30, 40}},
+		{"last", must(s.GetLast("ch", 3)), []int64{20, 30, 40}},
+	}
+	for _, tt := range tests {
+		if got := eventIDs(tt.got, base); !equalIDs(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedisStorageGC(t *testing.T) {
+	mr, client, stop := newTestRedis(t)
+	defer stop()
+	s := NewRedisStorage(client, "test:")
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).UnixNano()
+	fresh := now.UnixNano()
+	for _, e := range []struct {
+		channelID string
+		id        int64
+	}{{"old", old}, {"mixed", old}, {"mixed", fresh}} {
+		if _, err := s.NextID(e.channelID, e.id); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Add(e.channelID, Event{ID: e.id, Timestamp: e.id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetInboxState("mixed", []int64{old, fresh}, InboxRead); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.gc(time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d events, want 2", removed)
+	}
+	if got := s.GetAllInChannel("mixed"); len(got) != 1 || got[0].ID != fresh {
+		t.Errorf("mixed channel has %v, want only fresh event", got)
+	}
+	states, err := s.GetInboxStates("mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[fresh] != InboxRead {
+		t.Errorf("inbox states %v, want only fresh event", states)
+	}
+
+	// empty channel is forgotten with all its keys
+	for _, key := range []string{"test:events:old", "test:last_id:old"} {
+		if mr.Exists(key) {
+			t.Errorf("key %s hasn't been deleted", key)
+		}
+	}
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Channels != 1 || stats.Events != 1 {
+		t.Errorf("stats %+v, want 1 channel with 1 event", stats)
+	}
+}
+
+func eventIDs(events []Event, base int64) []int64 {
+	var ids []int64
+	for _, e := range events {
+		ids = append(ids, e.ID-base)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Reloader applies authentication and cors settings of the reloaded configuration to the running server,
+// other settings require restart
+type Reloader struct {
+	sync.Mutex
+	path    string
+	current Config
+	handler *Handler
+	cors    *CORS
+	log     Logger
+}
+
+// NewReloader is a factory func, returns a new instance of the Reloader structure
+func NewReloader(path string, current Config, handler *Handler, cors *CORS, log Logger) *Reloader {
+	return &Reloader{
+		path:    path,
+		current: current,
+		handler: handler,
+		cors:    cors,
+		log:     log,
+	}
+}
+
+// Reload loads configuration from the file and environment,
+// nothing is changed if the configuration is invalid.
+// Environment of the process doesn't change, so settings set by environment variables stay the same,
+// settings are changed by reload if they are set in the file or read from files named by *_FILE variables.
+func (r *Reloader) Reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if r.path == "" && len(envVars(reflect.TypeOf(Config{}), envFileSuffix, os.LookupEnv)) == 0 && !readsKeyFiles(cfg.Auth) {
+		return errors.New("nothing to reload: configuration file isn't set and no settings are read from files")
+	}
+	auth, err := NewAuth(cfg.Auth, r.log)
+	if err != nil {
+		return err
+	}
+
+	old := r.handler.Auth()
+	// signed requests accepted with the previous settings can't be replayed
+	auth.Signatures.ShareReplays(old.Signatures)
+	auth.Start(r.log)
+	r.handler.SetAuth(auth)
+	old.Close()
+	r.cors.SetAllowedOrigins(cfg.CORS.AllowedOrigins)
+
+	var fixed []string
+	for _, name := range append(
+		envVars(reflect.TypeOf(AuthConfig{}), "", os.LookupEnv),
+		envVars(reflect.TypeOf(CORSConfig{}), "", os.LookupEnv)...,
+	) {
+		// files named by variables like API_KEYS_FILE are read again
+		if !strings.HasSuffix(name, envFileSuffix) {
+			fixed = append(fixed, name)
+		}
+	}
+	if len(fixed) > 0 {
+		r.log.Warnf("settings of environment variables %s can't be changed by reload, use %s variables instead",
+			strings.Join(fixed, ", "), envFileSuffix)
+	}
+
+	if !reflect.DeepEqual(staticSettings(cfg), staticSettings(r.current)) {
+		r.log.Warnf("configuration has changed settings which are applied on restart only")
+	}
+	r.current = cfg
+	return nil
+}
+
+// Watch reloads configuration on SIGHUP, it blocks forever
+func (r *Reloader) Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := r.Reload(); err != nil {
+			r.log.Errorf("reload configuration: %v", err)
+			continue
+		}
+		r.log.With(Fields{"event": "config_reloaded"}).Infof("configuration has been reloaded")
+	}
+}
+
+// readsKeyFiles reports whether authentication reads keys from files, which are read again on reload
+func readsKeyFiles(cfg AuthConfig) bool {
+	return cfg.APIKeysFile != "" || cfg.JWT.PublicKeyFile != "" || cfg.JWT.JWKSFile != ""
+}
+
+// staticSettings returns configuration without settings which are reloaded at runtime
+func staticSettings(cfg Config) Config {
+	cfg.Auth = AuthConfig{}
+	cfg.CORS = CORSConfig{}
+	return cfg
+}
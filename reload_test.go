@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// verifySignature returns status of the request passed through signature verifier of the handler
+func verifySignature(h *Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	h.Auth().Signatures.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestReloadKeepsReplayProtection(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	path := writeFile(t, t.TempDir(), "config.yaml", "auth:\n  basic_token: old\n")
+	reloader := NewReloader(path, DefaultConfig(), h, NewCORS(nil), h.log)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if code := verifySignature(h, signedRequest("old", "/pub/ch", nil, now)); code != http.StatusOK {
+		t.Fatalf("signed request: status %d", code)
+	}
+	// reloaded configuration keeps the key
+	writeFile(t, "", path, "auth:\n  basic_token: old\n  signature_window: 10m\n")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code := verifySignature(h, signedRequest("old", "/pub/ch", nil, now)); code != http.StatusUnauthorized {
+		t.Errorf("request replayed after reload: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := verifySignature(h, signedRequest("old", "/pub/other", nil, now)); code != http.StatusOK {
+		t.Errorf("another signed request after reload: status %d", code)
+	}
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	before := h.Auth()
+	if err := NewReloader("", DefaultConfig(), h, NewCORS(nil), h.log).Reload(); err == nil {
+		t.Error("reload without configuration file hasn't failed")
+	}
+	if h.Auth() != before {
+		t.Error("authentication has been replaced")
+	}
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,7 @@ type (
 	// Event struct
 	Event struct {
 		ID        int64
+		Type      string `json:",omitempty"`
 		Data      EventData
 		TTL       int64 `json:"-"`
 		Timestamp int64 `json:"-"`
@@ -26,20 +28,87 @@ type (
 		Payload interface{} `json:"payload"`
 	}
 
+	// JSONEvent is a representation of the sse.Event for transports other than event stream
+	JSONEvent struct {
+		ID    string      `json:"id,omitempty"`
+		Event string      `json:"event"`
+		Data  interface{} `json:"data"`
+		// reconnection delay hint in milliseconds
+		Retry uint `json:"retry,omitempty"`
+	}
+
+	// Replay tells which events of history are sent to the new subscriber.
+	// Last event id takes precedence, so reconnected client receives everything it has missed,
+	// otherwise events published since given time and/or the most recent ones are replayed.
+	Replay struct {
+		LastEventID string
+		// the most recent events, zero means no limit
+		Last int
+		// events published at or after this time, zero means not set
+		Since time.Time
+		// consumer which acknowledges events, events it hasn't acknowledged are redelivered
+		// regardless of the last event id
+		Consumer string
+	}
+
 	// SSE struct
 	SSE struct {
 		storage Storage
+		hub     *Hub
+		relay   Relay
+		acks    *AckTracker
+		// events older than maxAge are removed by storage garbage collector
+		maxAge time.Duration
 	}
 )
 
+const defaultEventType = "message"
+
+// event types which are sent by the server itself
+var reservedEventTypes = map[string]bool{
+	"notification": true,
+	"reconnect":    true,
+	inboxEventType: true,
+}
+
+var eventTypeRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]{0,63}$`)
+
 // MapToSseEvent func to convert struct Event to sse.Event
 func (e Event) MapToSseEvent() sse.Event {
-	t := time.Unix(0, e.ID)
-	id := fmt.Sprintf("%d:%d", t.Unix(), t.Nanosecond())
-	return sse.Event{
-		Id:    id,
-		Event: "message",
+	eventType := e.Type
+	if eventType == "" {
+		eventType = defaultEventType
+	}
+	se := sse.Event{
+		Event: eventType,
+		Data:  e.Data,
+	}
+	// events which aren't stored, e.g. inbox state changes, have no id
+	if e.ID != 0 {
+		se.Id = formatEventID(e.ID)
+	}
+	return se
+}
+
+// ValidateEventType checks custom event type,
+// it must start with a letter and contain only letters, digits and "_.:-" characters
+func ValidateEventType(eventType string) error {
+	if !eventTypeRegexp.MatchString(eventType) {
+		return fmt.Errorf("event type %q must start with a letter and contain up to 64 letters, digits or \"_.:-\" characters", eventType)
+	}
+	if reservedEventTypes[eventType] {
+		return fmt.Errorf("event type %q is reserved", eventType)
+	}
+	return nil
+}
+
+// mapSseEventToJSON converts sse.Event to JSONEvent
+func mapSseEventToJSON(e sse.Event) JSONEvent {
+	return JSONEvent{
+		ID:    e.Id,
+		Event: e.Event,
 		Data:  e.Data,
+		Retry: e.Retry,
 	}
 }
 
@@ -52,63 +121,118 @@ func (e Event) IsExpired() bool {
 }
 
 // NewSSE factory
-func NewSSE(storage Storage) *SSE {
-	return &SSE{storage: storage}
+func NewSSE(storage Storage, hub *Hub, relay Relay, maxAge time.Duration) *SSE {
+	acks := NewAckTracker(maxAge)
+	hub.OnSubmit(acks.deliver)
+	return &SSE{storage: storage, hub: hub, relay: relay, acks: acks, maxAge: maxAge}
 }
 
-// PubEvent func publishes data to channel
-func (s *SSE) PubEvent(channelID string, data EventData, ttl int64) error {
-	t := time.Now().UnixNano()
+// EffectiveTTL returns number of seconds the event is available for delivery,
+// it's limited by the event ttl and by max age of events in storage
+func (s *SSE) EffectiveTTL(event Event) int64 {
+	maxAge := int64(s.maxAge / time.Second)
+	if event.TTL > 0 && (maxAge <= 0 || event.TTL < maxAge) {
+		return event.TTL
+	}
+	return maxAge
+}
+
+// PubEvent func publishes data to channel, returns the created event
+func (s *SSE) PubEvent(channelID, eventType string, data EventData, ttl int64) (Event, error) {
+	if eventType != "" {
+		if err := ValidateEventType(eventType); err != nil {
+			return Event{}, err
+		}
+	}
+
+	// the same reading of the clock is used for id and timestamp of the event
+	start := time.Now()
+	id, err := s.storage.NextID(strings.ToLower(channelID), start.UnixNano())
+	if err != nil {
+		return Event{}, fmt.Errorf("generate event id: %v", err)
+	}
 	event := Event{
-		ID:        t,
+		ID:        id,
+		Type:      eventType,
 		Data:      data,
 		TTL:       ttl,
-		Timestamp: t,
+		Timestamp: start.UnixNano(),
+	}
+	// event is stored before it's delivered, so subscribers never receive an event which can't be replayed
+	if err := s.storeEvent(channelID, event); err != nil {
+		return Event{}, err
 	}
-	channel(channelID).Submit(event)
-	return s.storeEvent(channelID, event)
+	if err := s.relay.Publish(channelID, event); err != nil {
+		// publisher retries failed publish, so the event isn't kept to not be replayed twice
+		s.storage.Delete(strings.ToLower(channelID), event)
+		return Event{}, err
+	}
+	publishDuration.Observe(time.Since(start).Seconds())
+	publishedCounter.WithLabelValues(channelPrefix(strings.ToLower(channelID))).Inc()
+	return event, nil
 }
 
 // SubscribeToChannel func
-func (s *SSE) SubscribeToChannel(channelID, lastEventID string) (chan interface{}, []Event, error) {
-	listener := openListener(channelID)
-	history := make([]Event, 0, 50)
-	var err error
-	if lastEventID != "" {
-		history, err = s.getEventsByLastID(channelID, lastEventID)
-		if err != nil {
-			return nil, nil, err
+func (s *SSE) SubscribeToChannel(channelID string, replay Replay) (*Subscriber, []Event, error) {
+	listener := s.hub.Open(channelID)
+	history, err := s.getHistory(channelID, replay)
+	if err == nil && replay.Consumer != "" {
+		var unacked []Event
+		if unacked, err = s.redeliver(channelID, replay.Consumer); err == nil {
+			history = mergeEvents(history, unacked)
+			s.acks.open(listener, replay.Consumer, map[string][]Event{strings.ToLower(channelID): unacked})
 		}
-		log.Printf("\nchannel: %s;\nlast event id: %s;\nhistory: %+v\n", channelID, lastEventID, history)
 	}
-	return listener, history, err
+	if err != nil {
+		s.hub.Close(channelID, listener)
+		return nil, nil, err
+	}
+	return listener, history, nil
 }
 
 // SubscribeToMultiChannel func
-func (s *SSE) SubscribeToMultiChannel(channels []string, lastEventID string) (chan interface{}, []Event, error) {
-	listener := openMultiChannelListener(channels)
+func (s *SSE) SubscribeToMultiChannel(channels []string, replay Replay) (*Subscriber, []Event, error) {
+	listener := s.hub.OpenMulti(channels)
 	history := make([]Event, 0, 100)
-	if lastEventID != "" {
-		for _, channelID := range channels {
-			events, err := s.getEventsByLastID(channelID, lastEventID)
-			if err != nil {
-				return nil, nil, err
-			}
-			history = append(history, events...)
+	var unacked []Event
+	pendingByChannel := make(map[string][]Event)
+	for _, channelID := range channels {
+		events, err := s.getHistory(channelID, replay)
+		if err == nil && replay.Consumer != "" {
+			var pending []Event
+			pending, err = s.redeliver(channelID, replay.Consumer)
+			unacked = append(unacked, pending...)
+			pendingByChannel[strings.ToLower(channelID)] = pending
 		}
+		if err != nil {
+			s.hub.CloseMulti(channels, listener)
+			return nil, nil, err
+		}
+		history = append(history, events...)
 	}
-	return listener, history, nil
+	if replay.Consumer != "" {
+		s.acks.open(listener, replay.Consumer, pendingByChannel)
+	}
+	// the most recent events of the whole group, unacknowledged events are always redelivered
+	return listener, mergeEvents(replay.limit(sortEvents(history)), sortEvents(unacked)), nil
+}
+
+// Done returns channel which is closed when the server is shutting down
+func (s *SSE) Done() <-chan struct{} {
+	return s.hub.Done()
 }
 
 // Unsubscribe from channel
-func (s *SSE) Unsubscribe(channelID string, listener chan interface{}) error {
-	closeListener(channelID, listener)
+func (s *SSE) Unsubscribe(channelID string, listener *Subscriber) error {
+	s.acks.close(listener)
+	s.hub.Close(channelID, listener)
 	return nil
 }
 
 // UnsubscribeFromMultiChannel from channel
-func (s *SSE) UnsubscribeFromMultiChannel(channels []string, listener chan interface{}) error {
-	closeMultiListener(channels, listener)
+func (s *SSE) UnsubscribeFromMultiChannel(channels []string, listener *Subscriber) error {
+	s.acks.close(listener)
+	s.hub.CloseMulti(channels, listener)
 	return nil
 }
 
@@ -118,29 +242,128 @@ func (s *SSE) DumpStorage(channelID string) []Event {
 	return s.storage.GetAllInChannel(channelID)
 }
 
+// History returns page of not expired events in a channel
+// and tells whether there are more events beyond the page
+func (s *SSE) History(channelID string, query PageQuery) ([]Event, bool, error) {
+	channelID = strings.ToLower(channelID)
+	limit := query.Limit
+	page := make([]Event, 0, limit)
+	for {
+		// one more event is requested to know whether the page is the last one
+		query.Limit = limit + 1 - len(page)
+		events, err := s.storage.GetPage(channelID, query)
+		if err != nil {
+			return nil, false, fmt.Errorf("get page of events: %v", err)
+		}
+		for _, event := range events {
+			if event.IsExpired() {
+				continue
+			}
+			if len(page) == limit {
+				return page, true, nil
+			}
+			page = append(page, event)
+		}
+		if len(events) < query.Limit {
+			return page, false, nil
+		}
+		// expired events have been skipped, continue after the last read one
+		if last := events[len(events)-1].ID; query.Descending {
+			query.BeforeID = last
+		} else {
+			query.AfterID = last
+		}
+	}
+}
+
 func (s *SSE) storeEvent(channelID string, event Event) error {
 	channelID = strings.ToLower(channelID)
 	return s.storage.Add(channelID, event)
 }
 
-func (s *SSE) getEventsByLastID(channelID, lastEventID string) ([]Event, error) {
+// getHistory returns events of a channel which are requested to be replayed
+func (s *SSE) getHistory(channelID string, replay Replay) ([]Event, error) {
 	channelID = strings.ToLower(channelID)
-	var events []Event
-	if lastEventID != "" && strings.Contains(lastEventID, ":") {
-		parts := strings.Split(lastEventID, ":")
-		if len(parts) != 2 {
-			return nil, errors.New("wrong last event id")
-		}
-		sec, err := strconv.Atoi(parts[0])
+	var (
+		events []Event
+		err    error
+	)
+	switch {
+	case replay.LastEventID != "":
+		lid, err := parseEventID(replay.LastEventID)
 		if err != nil {
-			return nil, fmt.Errorf("convert last event id to int64: %v", err)
+			return nil, err
 		}
-		nsec, err := strconv.Atoi(parts[1])
-		if err != nil {
-			return nil, fmt.Errorf("convert last event id to int64: %v", err)
-		}
-		lid := time.Unix(int64(sec), int64(nsec)).UnixNano()
 		events = s.storage.GetByLastID(channelID, lid)
+	case !replay.Since.IsZero():
+		since := replay.Since
+		if since.Before(time.Unix(0, 0)) {
+			since = time.Unix(0, 0)
+		}
+		if events, err = s.storage.GetSince(channelID, since); err != nil {
+			return nil, fmt.Errorf("get events since %s: %v", since, err)
+		}
+		events = replay.limit(events)
+	case replay.Last > 0:
+		if events, err = s.storage.GetLast(channelID, replay.Last); err != nil {
+			return nil, fmt.Errorf("get last events: %v", err)
+		}
+	default:
+		return nil, nil
 	}
+	replaySize.Observe(float64(len(events)))
 	return events, nil
 }
+
+// limit returns the most recent of sorted events, if number of events is limited
+// and client doesn't resume from the last event id
+func (r Replay) limit(events []Event) []Event {
+	if r.LastEventID == "" && r.Last > 0 && len(events) > r.Last {
+		return events[len(events)-r.Last:]
+	}
+	return events
+}
+
+// formatEventID returns canonical representation of the event id
+func formatEventID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// parseEventID parses event id in canonical format,
+// or in legacy "sec:nsec" format which was used before ids became sequences,
+// legacy ids are comparable with the canonical ones, see nextEventID
+func parseEventID(s string) (int64, error) {
+	id, err := parseRawEventID(s)
+	if err != nil {
+		return 0, err
+	}
+	// storages look for events after the id, so it must be followed by a valid one
+	if id < 0 || id == math.MaxInt64 {
+		return 0, fmt.Errorf("last event id %s is out of range", s)
+	}
+	return id, nil
+}
+
+func parseRawEventID(s string) (int64, error) {
+	if !strings.Contains(s, ":") {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("convert last event id to int64: %v", err)
+		}
+		return id, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("wrong last event id")
+	}
+	sec, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("convert last event id to int64: %v", err)
+	}
+	nsec, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("convert last event id to int64: %v", err)
+	}
+	return time.Unix(int64(sec), int64(nsec)).UnixNano(), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPubEventID(t *testing.T) {
+	sse := NewSSE(NewMemStorage(), NewHub(1, Disconnect), NewLocalRelay(NewHub(1, Disconnect)), time.Hour)
+
+	var lastID int64
+	for i := 0; i < 200; i++ {
+		event, err := sse.PubEvent("ch", "", EventData{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.ID <= lastID {
+			t.Fatalf("event %d: id %d isn't greater than previous %d", i, event.ID, lastID)
+		}
+		// storages find events published since given time by id
+		if event.ID < event.Timestamp {
+			t.Fatalf("event %d: id %d is less than timestamp %d", i, event.ID, event.Timestamp)
+		}
+		lastID = event.ID
+	}
+}
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1600000000123456789", 1600000000123456789, false},
+		// legacy format
+		{"1600000000:123456789", 1600000000123456789, false},
+		{"1600000000:123:1", 0, true},
+		{"abc", 0, true},
+		{"1600000000:abc", 0, true},
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"-1:0", 0, true},
+		// no event may follow the greatest id
+		{"9223372036854775807", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEventID(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseEventID(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if got := formatEventID(1600000000123456789); got != "1600000000123456789" {
+		t.Errorf("formatEventID() = %s", got)
+	}
+}
+
+// failingStorage fails to add events
+type failingStorage struct {
+	*MemStorage
+}
+
+func (s failingStorage) Add(channelID string, event Event) error {
+	return errors.New("disk is full")
+}
+
+// failingRelay fails to deliver events
+type failingRelay struct{}
+
+func (failingRelay) Publish(channelID string, event Event) error {
+	return errors.New("relay is down")
+}
+
+func TestPubEventFailure(t *testing.T) {
+	hub := NewHub(defaultQueueSize, Disconnect)
+	sse := NewSSE(failingStorage{NewMemStorage()}, hub, NewLocalRelay(hub), time.Hour)
+	listener := hub.Open("ch")
+	defer hub.Close("ch", listener)
+
+	if _, err := sse.PubEvent("ch", "", EventData{}, 0); err == nil {
+		t.Fatal("publish hasn't failed")
+	}
+	select {
+	case e := <-listener.Events():
+		t.Errorf("event which hasn't been stored is delivered: %+v", e)
+	default:
+	}
+
+	// event which hasn't been delivered isn't stored, so retry of publisher doesn't duplicate it
+	storage := NewMemStorage()
+	sse = NewSSE(storage, hub, failingRelay{}, time.Hour)
+	if _, err := sse.PubEvent("ch", "", EventData{}, 0); err == nil {
+		t.Fatal("publish hasn't failed")
+	}
+	if events := storage.GetAllInChannel("ch"); len(events) != 0 {
+		t.Errorf("event which hasn't been delivered is stored: %+v", events)
+	}
+}
+
+func TestValidateEventType(t *testing.T) {
+	tests := []struct {
+		eventType string
+		wantErr   bool
+	}{
+		{"order.created", false},
+		{"a", false},
+		{"Order_updated:v2-beta", false},
+		{"a" + strings.Repeat("b", 63), false},
+		{"a" + strings.Repeat("b", 64), true},
+		{"", true},
+		{"1order", true},
+		{"_order", true},
+		{"order created", true},
+		{"order\ncreated", true},
+		{"заказ", true},
+		// reserved types
+		{"notification", true},
+		{"reconnect", true},
+		{inboxEventType, true},
+	}
+	for _, tt := range tests {
+		if err := ValidateEventType(tt.eventType); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateEventType(%q) = %v, want error %v", tt.eventType, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPubEventType(t *testing.T) {
+	hub := NewHub(defaultQueueSize, Disconnect)
+	sse := NewSSE(NewMemStorage(), hub, NewLocalRelay(hub), time.Hour)
+
+	if _, err := sse.PubEvent("ch", "reconnect", EventData{}, 0); err == nil {
+		t.Error("event of reserved type is published")
+	}
+	event, err := sse.PubEvent("ch", "order.created", EventData{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := event.MapToSseEvent().Event; got != "order.created" {
+		t.Errorf("type of event = %q, want %q", got, "order.created")
+	}
+	event = publish(t, sse, "ch", "default")
+	if got := event.MapToSseEvent().Event; got != defaultEventType {
+		t.Errorf("type of event = %q, want %q", got, defaultEventType)
+	}
+}
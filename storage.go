@@ -1,9 +1,14 @@
 package main
 
 import (
-	"sync"
+	"encoding/json"
+	"errors"
+	"time"
 )
 
+// ErrConsumerNotRegistered is returned on acknowledgement by a consumer which isn't registered in the channel
+var ErrConsumerNotRegistered = errors.New("consumer isn't registered in the channel")
+
 type (
 	// Storage interface
 	Storage interface {
@@ -11,11 +16,142 @@ type (
 		GetAllInChannel(channelID string) []Event
 		// get events in a channel which has id greater than given one
 		GetByLastID(channelID string, lastEventID int64) []Event
+		// get the most recent events in a channel, up to given number
+		GetLast(channelID string, n int) ([]Event, error)
+		// get events in a channel which have been published at or after given time
+		GetSince(channelID string, since time.Time) ([]Event, error)
+		// get page of events in a channel
+		GetPage(channelID string, query PageQuery) ([]Event, error)
+		// NextID returns the next id of event in a channel which is published at given time in nanoseconds,
+		// the sequence of ids is shared by all channels
+		NextID(channelID string, now int64) (int64, error)
 		// Add event to storage
 		Add(channelID string, event Event) error
 		// Delete event from storage
 		Delete(channelID string, event Event) error
-		// Deletes event which is older then given time from channel
-		GC(eventMaxAge, gcPeriod string, wg *sync.WaitGroup) error
+		// SetInboxState sets state of events in a channel, unread state isn't stored
+		SetInboxState(channelID string, ids []int64, state InboxState) error
+		// GetInboxStates returns states of events in a channel which aren't unread
+		GetInboxStates(channelID string) (map[int64]InboxState, error)
+		// RegisterConsumer starts tracking of acknowledgements of the consumer in a channel,
+		// events up to given id aren't redelivered to it. Consumer which is already registered keeps its id,
+		// returns the id the consumer is registered with.
+		// Consumers of a channel without events are forgotten by gc when they are registered before max age.
+		RegisterConsumer(channelID, consumerID string, from int64) (int64, error)
+		// Ack records acknowledgements of events by the consumer,
+		// returns ErrConsumerNotRegistered if the consumer isn't registered in the channel
+		Ack(channelID, consumerID string, ids []int64) error
+		// GetAckState returns acknowledgements of the consumer in a channel
+		GetAckState(channelID, consumerID string) (AckState, error)
+		// GC periodically deletes events which are older than max age, it blocks until stop is closed.
+		// Acknowledgements of active consumers are kept as they are.
+		GC(maxAge, period time.Duration, active ActiveConsumers, stop <-chan struct{})
+		// Stats returns number of channels and events in storage
+		Stats() (StorageStats, error)
+		// Close flushes pending writes and releases resources of storage
+		Close() error
+	}
+
+	// ActiveConsumers reports whether the consumer has subscribers of a channel, it may be nil
+	ActiveConsumers func(channelID, consumerID string) bool
+
+	// PageQuery struct, selects page of events in a channel
+	PageQuery struct {
+		// exclusive bounds of event ids, zero means unbounded
+		AfterID  int64
+		BeforeID int64
+		// maximum number of events in the page
+		Limit int
+		// newest events first
+		Descending bool
+	}
+
+	// AckState struct, acknowledgements of events in a channel by a consumer
+	AckState struct {
+		// events up to this id aren't redelivered, zero if the consumer isn't registered
+		From  int64
+		Acked map[int64]bool
+	}
+
+	// StorageStats struct
+	StorageStats struct {
+		Channels int
+		Events   int
+	}
+
+	// storedEvent is a representation of the Event used by persistent storages,
+	// it keeps fields which are hidden from the json output of the Event
+	storedEvent struct {
+		ID        int64     `json:"id"`
+		Type      string    `json:"type,omitempty"`
+		Data      EventData `json:"data"`
+		TTL       int64     `json:"ttl,omitempty"`
+		Timestamp int64     `json:"timestamp"`
 	}
 )
+
+// nextEventID returns id of event published at given time in nanoseconds, following the last id used in any channel.
+// Ids are strictly increasing across channels even if the clock goes back or clocks of instances differ,
+// so a single cursor of multi channel subscription doesn't skip events, and they are never less
+// than the timestamp of the event, so storages find events published since given time or older than max age by id.
+func nextEventID(lastID, now int64) int64 {
+	if now > lastID {
+		return now
+	}
+	return lastID + 1
+}
+
+// publishedSince returns events which have been published at or after given time in nanoseconds
+func publishedSince(events []Event, t int64) []Event {
+	res := events[:0:0]
+	for _, event := range events {
+		if event.Timestamp >= t {
+			res = append(res, event)
+		}
+	}
+	return res
+}
+
+// has reports whether the consumer of a channel is active
+func (a ActiveConsumers) has(channelID, consumerID string) bool {
+	return a != nil && a(channelID, consumerID)
+}
+
+// pruneAckState forgets acknowledgements of events older than given time in nanoseconds,
+// such events are removed from storage, so they can't be redelivered anyway
+func pruneAckState(state *AckState, t int64) {
+	for id := range state.Acked {
+		if id < t {
+			delete(state.Acked, id)
+		}
+	}
+	if state.From != 0 && state.From < t {
+		state.From = t
+	}
+}
+
+// encodeEvent serializes event to be saved in a persistent storage
+func encodeEvent(event Event) ([]byte, error) {
+	return json.Marshal(storedEvent{
+		ID:        event.ID,
+		Type:      event.Type,
+		Data:      event.Data,
+		TTL:       event.TTL,
+		Timestamp: event.Timestamp,
+	})
+}
+
+// decodeEvent restores event from its serialized representation
+func decodeEvent(b []byte) (Event, error) {
+	se := storedEvent{}
+	if err := json.Unmarshal(b, &se); err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:        se.ID,
+		Type:      se.Type,
+		Data:      se.Data,
+		TTL:       se.TTL,
+		Timestamp: se.Timestamp,
+	}, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forEachStorage runs the test against a new instance of every storage implementation
+func forEachStorage(t *testing.T, test func(t *testing.T, s Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemStorage())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := NewBoltStorage(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+	t.Run("redis", func(t *testing.T) {
+		_, client, stop := newTestRedis(t)
+		defer stop()
+		test(t, NewRedisStorage(client, "test:"))
+	})
+}
+
+// collectGarbageNow runs one pass of garbage collector of the storage
+func collectGarbageNow(t *testing.T, s Storage, maxAge time.Duration, active ActiveConsumers) int {
+	t.Helper()
+	removed, err := s.(interface {
+		gc(maxAge time.Duration, active ActiveConsumers) (int, error)
+	}).gc(maxAge, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return removed
+}
+
+// mustEvents returns events read from the storage, or fails the test if they can't be read
+func mustEvents(t *testing.T) func(events []Event, err error) []Event {
+	return func(events []Event, err error) []Event {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+}
+
+// addEvents adds events with given ids to the channel, timestamps are equal to ids
+func addEvents(t *testing.T, s Storage, channelID string, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		if err := s.Add(channelID, Event{ID: id, Timestamp: id, Data: EventData{Title: channelID}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorageQueries(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		addEvents(t, s, "ch", 10, 20, 30, 40)
+		addEvents(t, s, "other", 15)
+		must := mustEvents(t)
+
+		tests := []struct {
+			name string
+			got  []Event
+			want []int64
+		}{
+			{"all", s.GetAllInChannel("ch"), []int64{10, 20, 30, 40}},
+			{"by last id", s.GetByLastID("ch", 20), []int64{30, 40}},
+			// cursor of multi channel subscription may come from another channel
+			{"by id of another channel", s.GetByLastID("ch", 15), []int64{20, 30, 40}},
+			{"by the last id", s.GetByLastID("ch", 40), nil},
+			{"last", must(s.GetLast("ch", 2)), []int64{30, 40}},
+			{"last more than stored", must(s.GetLast("ch", 10)), []int64{10, 20, 30, 40}},
+			{"since", must(s.GetSince("ch", time.Unix(0, 20))), []int64{20, 30, 40}},
+			{"since between events", must(s.GetSince("ch", time.Unix(0, 25))), []int64{30, 40}},
+			{"page", must(s.GetPage("ch", PageQuery{Limit: 2})), []int64{10, 20}},
+			{"page after", must(s.GetPage("ch", PageQuery{AfterID: 15, Limit: 2})), []int64{20, 30}},
+			{"page between", must(s.GetPage("ch", PageQuery{AfterID: 10, BeforeID: 40, Limit: 10})), []int64{20, 30}},
+			{"descending page", must(s.GetPage("ch", PageQuery{Limit: 3, Descending: true})), []int64{40, 30, 20}},
+			{"descending page before", must(s.GetPage("ch", PageQuery{BeforeID: 30, Limit: 3, Descending: true})), []int64{20, 10}},
+			{"unknown channel", s.GetAllInChannel("nope"), nil},
+		}
+		for _, tt := range tests {
+			if got := eventIDs(tt.got, 0); !equalIDs(got, tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		if events := s.GetByLastID("other", 0); len(events) != 1 || events[0].Data.Title != "other" {
+			t.Errorf("event isn't stored as is: %+v", events)
+		}
+
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != (StorageStats{Channels: 2, Events: 5}) {
+			t.Errorf("stats %+v", stats)
+		}
+	})
+}
+
+func TestStorageNextID(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		tests := []struct {
+			channelID string
+			now       int64
+			want      int64
+		}{
+			{"ch", 100, 100},
+			{"ch", 100, 101},
+			{"ch", 50, 102},
+			{"ch", 200, 200},
+			// ids of channels are comparable, so a cursor of multi channel subscription doesn't skip events
+			{"other", 50, 201},
+			{"ch", 60, 202},
+		}
+		for _, tt := range tests {
+			id, err := s.NextID(tt.channelID, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.want {
+				t.Errorf("%s at %d: got %d, want %d", tt.channelID, tt.now, id, tt.want)
+			}
+		}
+	})
+}
+
+func TestStorageDelete(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		addEvents(t, s, "ch", 10, 20, 30)
+		if err := s.SetInboxState("ch", []int64{20}, InboxRead); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("ch", Event{ID: 20}); err != nil {
+			t.Fatal(err)
+		}
+		if got := eventIDs(s.GetAllInChannel("ch"), 0); !equalIDs(got, []int64{10, 30}) {
+			t.Errorf("got %v, want [10 30]", got)
+		}
+		if states, _ := s.GetInboxStates("ch"); len(states) != 0 {
+			t.Errorf("state of deleted event is left: %v", states)
+		}
+	})
+}
+
+func TestStorageInboxStates(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		addEvents(t, s, "ch", 10, 20, 30)
+		steps := []struct {
+			ids   []int64
+			state InboxState
+			want  map[int64]InboxState
+		}{
+			{[]int64{10, 20}, InboxRead, map[int64]InboxState{10: InboxRead, 20: InboxRead}},
+			{[]int64{20}, InboxDismissed, map[int64]InboxState{10: InboxRead, 20: InboxDismissed}},
+			// unread state isn't stored
+			{[]int64{10}, InboxUnread, map[int64]InboxState{20: InboxDismissed}},
+			{nil, InboxRead, map[int64]InboxState{20: InboxDismissed}},
+		}
+		for i, step := range steps {
+			if err := s.SetInboxState("ch", step.ids, step.state); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.GetInboxStates("ch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(step.want) {
+				t.Errorf("step %d: got %v, want %v", i, got, step.want)
+				continue
+			}
+			for id, state := range step.want {
+				if got[id] != state {
+					t.Errorf("step %d: got %v, want %v", i, got, step.want)
+				}
+			}
+		}
+		if states, _ := s.GetInboxStates("other"); len(states) != 0 {
+			t.Errorf("states of another channel: %v", states)
+		}
+	})
+}
+
+func TestStorageAcks(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		from, err := s.RegisterConsumer("ch", "c1", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// registered consumer keeps its id
+		if again, err := s.RegisterConsumer("ch", "c1", 200); err != nil || again != from || from != 100 {
+			t.Fatalf("registered with %d, then with %d, %v, want 100", from, again, err)
+		}
+		if err := s.Ack("ch", "c1", []int64{110, 120}); err != nil {
+			t.Fatal(err)
+		}
+		state, err := s.GetAckState("ch", "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.From != 100 || len(state.Acked) != 2 || !state.Acked[110] || !state.Acked[120] {
+			t.Errorf("got state %+v", state)
+		}
+		// consumers are tracked per channel
+		if state, _ := s.GetAckState("other", "c1"); state.From != 0 || len(state.Acked) != 0 {
+			t.Errorf("state in another channel: %+v", state)
+		}
+	})
+}
+
+func TestStorageGC(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		now := time.Now().UnixNano()
+		old, expired := now-3*time.Hour.Nanoseconds(), now-2*time.Hour.Nanoseconds()
+		addEvents(t, s, "ch", old, expired, now)
+		addEvents(t, s, "stale", old)
+		if err := s.SetInboxState("ch", []int64{old, now}, InboxRead); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RegisterConsumer("ch", "c1", old-1); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Ack("ch", "c1", []int64{old, now}); err != nil {
+			t.Fatal(err)
+		}
+
+		if removed := collectGarbageNow(t, s, time.Hour, nil); removed != 3 {
+			t.Errorf("removed %d events, want 3", removed)
+		}
+		if got := eventIDs(s.GetAllInChannel("ch"), 0); !equalIDs(got, []int64{now}) {
+			t.Errorf("got %v, want only the recent event", got)
+		}
+		if states, _ := s.GetInboxStates("ch"); len(states) != 1 || states[now] != InboxRead {
+			t.Errorf("inbox states %v, want only state of the recent event", states)
+		}
+		state, err := s.GetAckState("ch", "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.Acked) != 1 || !state.Acked[now] || state.From <= expired {
+			t.Errorf("ack state %+v, want only the recent event acknowledged and registration moved forward", state)
+		}
+		if stats, _ := s.Stats(); stats != (StorageStats{Channels: 1, Events: 1}) {
+			t.Errorf("stats %+v, want the empty channel forgotten", stats)
+		}
+	})
+}
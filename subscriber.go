@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// OverflowPolicy defines what happens with a new event when subscriber's queue is full
+	OverflowPolicy string
+
+	// Subscriber is a listener of one or more channels.
+	// Events are delivered through the bounded queue, so a slow subscriber
+	// never blocks delivery to the other subscribers of the channel.
+	Subscriber struct {
+		events  chan interface{}
+		evicted chan struct{}
+		policy  OverflowPolicy
+		dropped uint64
+		once    sync.Once
+	}
+)
+
+// Overflow policies
+const (
+	// Disconnect evicts the subscriber, so it has to reconnect with the last received event id
+	// and receives missed events from storage, no event is lost silently
+	Disconnect OverflowPolicy = "disconnect"
+	// DropOldest removes the oldest queued event to free space for the new one
+	DropOldest OverflowPolicy = "drop_oldest"
+	// DropNewest discards the new event
+	DropNewest OverflowPolicy = "drop_newest"
+)
+
+const (
+	defaultQueueSize      int            = 64
+	defaultOverflowPolicy OverflowPolicy = Disconnect
+)
+
+// ParseOverflowPolicy converts string to OverflowPolicy, empty string falls back to default policy
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case "":
+		return defaultOverflowPolicy, nil
+	case DropOldest, DropNewest, Disconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy: %s", s)
+}
+
+// NewSubscriber is a factory func, returns a new instance of the Subscriber structure
+func NewSubscriber(queueSize int, policy OverflowPolicy) *Subscriber {
+	if queueSize < 1 {
+		queueSize = defaultQueueSize
+	}
+	return &Subscriber{
+		events:  make(chan interface{}, queueSize),
+		evicted: make(chan struct{}),
+		policy:  policy,
+	}
+}
+
+// Events returns queue of events
+func (s *Subscriber) Events() <-chan interface{} {
+	return s.events
+}
+
+// Evicted returns channel which is closed when subscriber has been disconnected by overflow policy
+func (s *Subscriber) Evicted() <-chan struct{} {
+	return s.evicted
+}
+
+// Dropped returns number of events which have not been delivered to the subscriber
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// offer puts event into the queue without blocking,
+// returns false if event (or an older one) has been dropped
+// and whether the subscriber has been evicted by this call
+func (s *Subscriber) offer(event interface{}) (ok, evicted bool) {
+	select {
+	case s.events <- event:
+		return true, false
+	default:
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+
+	switch s.policy {
+	case DropNewest:
+	case DropOldest:
+		for {
+			select {
+			case <-s.events:
+			default:
+			}
+			select {
+			case s.events <- event:
+				return false, false
+			default:
+			}
+		}
+	default:
+		s.once.Do(func() {
+			close(s.evicted)
+			evicted = true
+		})
+	}
+
+	return false, evicted
+}
@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    OverflowPolicy
+		wantErr bool
+	}{
+		{"", Disconnect, false},
+		{"disconnect", Disconnect, false},
+		{"drop_oldest", DropOldest, false},
+		{"drop_newest", DropNewest, false},
+		{"drop_all", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOverflowPolicy(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSubscriberOverflow(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		wantQueued  []int
+		wantEvicted bool
+	}{
+		{Disconnect, []int{1, 2}, true},
+		{DropOldest, []int{3, 4}, false},
+		{DropNewest, []int{1, 2}, false},
+		// subscriber created without policy isn't allowed to lose events silently
+		{"", []int{1, 2}, true},
+	}
+	for _, tt := range tests {
+		sub := NewSubscriber(2, tt.policy)
+		for i := 1; i <= 2; i++ {
+			if ok, evicted := sub.offer(i); !ok || evicted {
+				t.Fatalf("%q: offer(%d) = %v, %v to not full queue", tt.policy, i, ok, evicted)
+			}
+		}
+
+		ok, evicted := sub.offer(3)
+		if ok || evicted != tt.wantEvicted {
+			t.Errorf("%q: offer to full queue = %v, %v, want false, %v", tt.policy, ok, evicted, tt.wantEvicted)
+		}
+		// the subscriber is evicted only once
+		if _, evicted := sub.offer(4); evicted {
+			t.Errorf("%q: subscriber has been evicted twice", tt.policy)
+		}
+		if sub.Dropped() != 2 {
+			t.Errorf("%q: dropped %d events, want 2", tt.policy, sub.Dropped())
+		}
+
+		select {
+		case <-sub.Evicted():
+			if !tt.wantEvicted {
+				t.Errorf("%q: subscriber has been evicted", tt.policy)
+			}
+		default:
+			if tt.wantEvicted {
+				t.Errorf("%q: subscriber hasn't been evicted", tt.policy)
+			}
+		}
+
+		var queued []int
+		for len(sub.Events()) > 0 {
+			queued = append(queued, (<-sub.Events()).(int))
+		}
+		if len(queued) != len(tt.wantQueued) || queued[0] != tt.wantQueued[0] || queued[1] != tt.wantQueued[1] {
+			t.Errorf("%q: queued %v, want %v", tt.policy, queued, tt.wantQueued)
+		}
+	}
+}
+
+func TestHubSubmit(t *testing.T) {
+	hub := NewHub(1, Disconnect)
+	fast := hub.Open("News")
+	slow := hub.OpenMulti([]string{"news", "other"})
+
+	hub.Submit("NEWS", 1)
+	<-fast.Events()
+	hub.Submit("news", 2)
+
+	// slow subscriber is evicted, but it doesn't block delivery to the other one
+	if got := <-fast.Events(); got != 2 {
+		t.Errorf("fast subscriber got %v, want 2", got)
+	}
+	select {
+	case <-slow.Evicted():
+	default:
+		t.Error("slow subscriber hasn't been evicted")
+	}
+	if hub.Dropped() != 1 || hub.Evicted() != 1 {
+		t.Errorf("hub dropped %d and evicted %d, want 1 and 1", hub.Dropped(), hub.Evicted())
+	}
+
+	hub.CloseMulti([]string{"news", "other"}, slow)
+	if hub.Len() != 1 {
+		t.Errorf("hub has %d channels, want 1", hub.Len())
+	}
+	hub.Close("news", fast)
+	if hub.Len() != 0 {
+		t.Errorf("hub has %d channels, want 0", hub.Len())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// certificate files are checked for changes not more often than this
+var certCheckInterval = 10 * time.Second
+
+// CertReloader loads tls certificate from files and reloads it when files are changed,
+// so renewed certificate is used without restart of the server
+type CertReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+	log       Logger
+}
+
+// NewCertReloader is a factory func, loads certificate and returns a new instance of the CertReloader structure
+func NewCertReloader(certFile, keyFile string, log Logger) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log,
+	}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate,
+// it reloads certificate if files have been changed since the last check.
+// The current certificate is kept if new files can't be loaded, e.g. while they are being written.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.checkedAt) >= certCheckInterval {
+		r.checkedAt = time.Now()
+		if modTime, err := r.filesModTime(); err != nil {
+			r.log.Errorf("check tls certificate: %v", err)
+		} else if !modTime.Equal(r.modTime) {
+			if err := r.load(modTime); err != nil {
+				r.log.Errorf("reload tls certificate: %v", err)
+			} else {
+				r.log.With(Fields{"event": "tls_certificate_reloaded"}).Infof("tls certificate has been reloaded from %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// filesModTime returns the latest modification time of certificate and key files
+func (r *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// configureHTTP2 enables http/2 on the server: over tls if certificate is configured,
+// or over cleartext connections (h2c) if the server is behind tls terminating proxy.
+// Http/2 over tls is served by net/http itself, x/net is used for h2c only.
+func configureHTTP2(srv *http.Server, cfg TLSConfig, log Logger) error {
+	if cfg.Enabled() {
+		certs, err := NewCertReloader(cfg.CertFile, cfg.KeyFile, log)
+		if err != nil {
+			return err
+		}
+		// net/http negotiates http/2 by itself when it serves tls
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		return nil
+	}
+	if cfg.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// time allowed to the client to send the first frame
+	wsHandshakeTimeout = 10 * time.Second
+	// time allowed to write a message to the client
+	wsWriteTimeout = 10 * time.Second
+	// maximum size of a message from the client
+	wsMaxMessageSize = 4096
+)
+
+var (
+	// time allowed to read the next pong message from the client
+	wsPongTimeout = 60 * time.Second
+	// send pings to the client with this period, must be less than wsPongTimeout
+	wsPingPeriod = wsPongTimeout * 9 / 10
+)
+
+type (
+	// wsHello is the first frame which client sends after connection,
+	// it may be an empty object if the client doesn't need to resume
+	wsHello struct {
+		LastEventID string `json:"last_event_id"`
+	}
+)
+
+// wsUpgrader checks that origin of the request is the same as the host, unless cors settings are set to the handler
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+func (h *Handler) websocketSingleChannel(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
+	channelID := chi.URLParam(r, "channel")
+	if channelID == "" {
+		log.Debugf("missed channel id")
+		http.Error(w, "Missed channel id!", http.StatusBadRequest)
+		return
+	}
+	log = log.With(Fields{"channel": channelID})
+
+	replay, err := getReplay(r)
+	if err != nil {
+		log.Debugf("wrong history replay: %v", err)
+		http.Error(w, fmt.Sprintf("Wrong history replay: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	conn, lastEventID, err := h.openWebsocket(w, r)
+	if err != nil {
+		log.Errorf("open websocket: %v (channel id: %s)", err, channelID)
+		return
+	}
+	defer conn.Close()
+
+	replay.LastEventID = lastEventID
+	listener, history, err := h.sse.SubscribeToChannel(channelID, replay)
+	if err != nil {
+		log.Errorf("subscribe to channel %s with last event id %s: %v", channelID, lastEventID, err)
+		closeWebsocket(conn, websocket.CloseInternalServerErr, "Could not subscribe to events channel")
+		return
+	}
+	defer h.sse.Unsubscribe(channelID, listener)
+	defer trackConnection(r)()
+
+	log.With(Fields{"event": "ws_client_connected"}).Debugf("client connected: %s", channelID)
+	h.streamWebsocket(log, conn, listener, history, lastEventID, channelID)
+}
+
+func (h *Handler) websocketMultiChannels(w http.ResponseWriter, r *http.Request) {
+	log := h.requestLog(r)
+	channelsStr := chi.URLParam(r, "channels")
+	if channelsStr == "" {
+		log.Debugf("missed channel id")
+		http.Error(w, "Missed channel id!", http.StatusBadRequest)
+		return
+	}
+	channels := strings.Split(channelsStr, ",")
+	log = log.With(Fields{"channel": channelsStr})
+
+	replay, err := getReplay(r)
+	if err != nil {
+		log.Debugf("wrong history replay: %v", err)
+		http.Error(w, fmt.Sprintf("Wrong history replay: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	conn, lastEventID, err := h.openWebsocket(w, r)
+	if err != nil {
+		log.Errorf("open websocket: %v (channels: %s)", err, channelsStr)
+		return
+	}
+	defer conn.Close()
+
+	replay.LastEventID = lastEventID
+	listener, history, err := h.sse.SubscribeToMultiChannel(channels, replay)
+	if err != nil {
+		log.Errorf("subscribe to channels group %s with last event id %s: %v", channelsStr, lastEventID, err)
+		closeWebsocket(conn, websocket.CloseInternalServerErr, "Could not subscribe to events channel")
+		return
+	}
+	defer h.sse.UnsubscribeFromMultiChannel(channels, listener)
+	defer trackConnection(r)()
+
+	log.With(Fields{"event": "ws_client_connected_group"}).Debugf("client connected to channels group: %s", channelsStr)
+	h.streamWebsocket(log, conn, listener, history, lastEventID, channelsStr)
+}
+
+// openWebsocket upgrades connection and waits for the first client frame,
+// returns last event id sent by the client or passed in the request
+func (h *Handler) openWebsocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, string, error) {
+	// token may be passed in the query string, so pages of other sites must not be able to connect
+	upgrader := wsUpgrader
+	if h.cors != nil {
+		upgrader.CheckOrigin = h.cors.OriginAllowed
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+
+	hello := wsHello{}
+	conn.SetReadDeadline(time.Now().Add(wsHandshakeTimeout))
+	if err := conn.ReadJSON(&hello); err != nil {
+		closeWebsocket(conn, websocket.ClosePolicyViolation, "Expected first frame with last event id")
+		conn.Close()
+		return nil, "", err
+	}
+	if hello.LastEventID == "" {
+		hello.LastEventID = getLastEventID(r)
+	}
+	if hello.LastEventID != "" {
+		if _, err := parseEventID(hello.LastEventID); err != nil {
+			closeWebsocket(conn, websocket.ClosePolicyViolation, "Wrong last event id")
+			conn.Close()
+			return nil, "", err
+		}
+	}
+
+	if err := writeWebsocket(conn, sse.Event{
+		Event: "notification",
+		Data:  "WebSocket connection successfully established",
+	}); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	return conn, hello.LastEventID, nil
+}
+
+// streamWebsocket sends history and then live events to the client until it disconnects
+func (h *Handler) streamWebsocket(log Logger, conn *websocket.Conn, listener *Subscriber, history []Event, lastEventID, channels string) {
+	// read loop handles control frames and detects closed connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// send historical events
+	for _, event := range history {
+		if !event.IsExpired() {
+			se := event.MapToSseEvent()
+			if err := writeWebsocket(conn, se); err != nil {
+				log.With(Fields{"event_id": se.Id}).Errorf("websocket encoding: %s (channels: %s, event: %#v)", err.Error(), channels, event)
+				return
+			}
+			lastEventID = se.Id
+			if log.Enabled(DebugLevel) {
+				log.With(Fields{"event": "ws_received_events_history", "event_id": se.Id}).Debugf("channels %s: received event: %+v", channels, event)
+			}
+		}
+	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			log.With(Fields{"event": "ws_client_disconnected", "dropped": listener.Dropped()}).Debugf("client closed connection: %s", channels)
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				log.With(Fields{"event": "ws_client_disconnected"}).Debugf("ping client: %s (channels: %s)", err.Error(), channels)
+				return
+			}
+		case <-listener.Evicted():
+			log.With(Fields{"event": "ws_client_evicted", "dropped": listener.Dropped()}).Warnf("slow client disconnected: %s", channels)
+			if err := writeWebsocket(conn, reconnectEvent(reconnectSlowConsumer, lastEventID, 0)); err == nil {
+				closeWebsocket(conn, websocket.CloseTryAgainLater, "slow consumer")
+			}
+			return
+		case <-h.sse.Done():
+			log.With(Fields{"event": "ws_client_shutdown"}).Debugf("server is shutting down, disconnect client: %s", channels)
+			if err := writeWebsocket(conn, reconnectEvent(reconnectShutdown, lastEventID, shutdownRetry())); err == nil {
+				closeWebsocket(conn, websocket.CloseServiceRestart, "server is shutting down")
+			}
+			return
+		case event := <-listener.Events():
+			if e, ok := event.(Event); ok {
+				se := e.MapToSseEvent()
+				if err := writeWebsocket(conn, se); err != nil {
+					log.With(Fields{"event_id": se.Id}).Errorf("websocket encoding: %s (channels: %s, event: %#v)", err.Error(), channels, event)
+					return
+				}
+				if se.Id != "" {
+					lastEventID = se.Id
+				}
+				if log.Enabled(DebugLevel) {
+					log.With(Fields{"event": "ws_received_event", "event_id": se.Id}).Debugf("channels %s: received event: %+v", channels, event)
+				}
+			} else {
+				log.Errorf("event is not Event type: %#v", event)
+			}
+		}
+	}
+}
+
+// writeWebsocket sends sse.Event to the client as json text frame
+func writeWebsocket(conn *websocket.Conn, e sse.Event) error {
+	b, err := json.Marshal(mapSseEventToJSON(e))
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func closeWebsocket(conn *websocket.Conn, code int, text string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteTimeout))
+}
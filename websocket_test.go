@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebsocket connects to the websocket endpoint of the server and sends the first frame
+func dialWebsocket(t *testing.T, srv *httptest.Server, path string, hello wsHello, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	if err := conn.WriteJSON(hello); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	greeting := readWebsocket(t, conn)
+	if greeting.Event != "notification" {
+		t.Fatalf("got %+v, want greeting", greeting)
+	}
+	return conn, resp, nil
+}
+
+func readWebsocket(t *testing.T, conn *websocket.Conn) JSONEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	e := JSONEvent{}
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestWebsocketResume(t *testing.T) {
+	h, sse := newTestHandler(t, NewMemStorage())
+	srv := httptest.NewServer(h.Router())
+	defer srv.Close()
+	var ids []string
+	for _, title := range []string{"1", "2", "3"} {
+		ids = append(ids, formatEventID(publish(t, sse, "ch", title).ID))
+	}
+
+	conn, _, err := dialWebsocket(t, srv, "/ws/ch", wsHello{LastEventID: ids[0]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// events after the last event id are replayed, then live events are sent
+	for _, want := range ids[1:] {
+		if e := readWebsocket(t, conn); e.ID != want {
+			t.Fatalf("got event %s, want %s", e.ID, want)
+		}
+	}
+	live := formatEventID(publish(t, sse, "ch", "4").ID)
+	if e := readWebsocket(t, conn); e.ID != live {
+		t.Errorf("got event %s, want live event %s", e.ID, live)
+	}
+}
+
+func TestWebsocketPing(t *testing.T) {
+	defer func(period time.Duration) { wsPingPeriod = period }(wsPingPeriod)
+	wsPingPeriod = 10 * time.Millisecond
+
+	h, _ := newTestHandler(t, NewMemStorage())
+	srv := httptest.NewServer(h.Router())
+	defer srv.Close()
+	conn, _, err := dialWebsocket(t, srv, "/ws-multi/a,b", wsHello{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pings := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	// control frames are handled while reading
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Error("server hasn't sent ping")
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	h, _ := newTestHandler(t, NewMemStorage())
+	h.SetCORS(NewCORS([]string{"https://*.example.com"}))
+	srv := httptest.NewServer(h.Router())
+	defer srv.Close()
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"", true},
+		{"https://evil.com", false},
+		{"https://example.com.evil.com", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := dialWebsocket(t, srv, "/ws/ch", wsHello{}, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.want {
+			t.Errorf("origin %q: error %v, want allowed %v", tt.origin, err, tt.want)
+		}
+		if !tt.want && resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: status %d, want %d", tt.origin, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+}